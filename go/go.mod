@@ -3,16 +3,18 @@ module github.com/nochte/pipelinr-clients/go
 go 1.18
 
 require (
+	github.com/amsokol/mongo-go-driver-protobuf v1.0.0-rc5
 	github.com/imroc/req/v3 v3.13.1
 	github.com/nochte/pipelinr-lib v0.0.0-20210824021320-549fe0445b69
 	github.com/nochte/pipelinr-protocol v1.2.0
 	github.com/smartystreets/goconvey v1.6.4
 	github.com/tidwall/gjson v1.14.1
+	go.mongodb.org/mongo-driver v1.9.1
 	google.golang.org/grpc v1.35.0
+	google.golang.org/protobuf v1.28.0
 )
 
 require (
-	github.com/amsokol/mongo-go-driver-protobuf v1.0.0-rc5 // indirect
 	github.com/gogo/protobuf v1.3.2 // indirect
 	github.com/golang/protobuf v1.5.2 // indirect
 	github.com/gopherjs/gopherjs v0.0.0-20181017120253-0766667cb4d1 // indirect
@@ -23,10 +25,8 @@ require (
 	github.com/tidwall/match v1.1.1 // indirect
 	github.com/tidwall/pretty v1.2.0 // indirect
 	github.com/wolfeidau/unflatten v1.1.0 // indirect
-	go.mongodb.org/mongo-driver v1.9.1 // indirect
 	golang.org/x/net v0.0.0-20220111093109-d55c255bac03 // indirect
 	golang.org/x/sys v0.0.0-20210615035016-665e8c7367d1 // indirect
 	golang.org/x/text v0.3.7 // indirect
 	google.golang.org/genproto v0.0.0-20210226172003-ab064af71705 // indirect
-	google.golang.org/protobuf v1.28.0 // indirect
 )
@@ -0,0 +1,72 @@
+package retry
+
+import (
+	"sync"
+)
+
+// Budget limits retries to a share of the calls that succeed, for every Policy that shares it, so
+//  clients retrying through an outage don't add to it. It is safe for concurrent use
+// Each success deposits ratio of a retry, up to reserve retries, and each retry withdraws one; a retry
+//  is only made while there is one to withdraw
+type Budget struct {
+	mu      sync.Mutex
+	ratio   float64
+	reserve float64
+	balance float64
+	stats   BudgetStats
+}
+
+// BudgetStats counts what a Budget has allowed
+type BudgetStats struct {
+	// Successes is the number of successful calls deposited
+	Successes uint64
+	// Retries is the number of retries allowed
+	Retries uint64
+	// Denied is the number of retries refused for lack of budget
+	Denied uint64
+}
+
+// NewBudget returns a Budget allowing retries for ratio of successful calls, ex: 0.1 for 10%, and
+//  holding up to reserve retries, which it starts with, for bursts of failures. A reserve of less than
+//  1 is 1, as a retry is only made once a whole one has been earned
+func NewBudget(ratio float64, reserve int) *Budget {
+	if reserve < 1 {
+		reserve = 1
+	}
+	return &Budget{
+		ratio:   ratio,
+		reserve: float64(reserve),
+		balance: float64(reserve),
+	}
+}
+
+// Deposit records a successful call
+func (b *Budget) Deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.stats.Successes++
+	b.balance += b.ratio
+	if b.balance > b.reserve {
+		b.balance = b.reserve
+	}
+}
+
+// Withdraw returns whether a retry may be made, spending it from the budget if so
+func (b *Budget) Withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.balance < 1 {
+		b.stats.Denied++
+		return false
+	}
+	b.balance--
+	b.stats.Retries++
+	return true
+}
+
+// Stats returns a snapshot of the Budget's counters
+func (b *Budget) Stats() BudgetStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.stats
+}
@@ -0,0 +1,148 @@
+package retry
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Backoff returns how long to wait before retry <attempt> (1 for the first retry), given the wait before
+//  the previous one (0 for the first)
+type Backoff func(attempt int, previous time.Duration) time.Duration
+
+// Policy decides how often, how far apart and for which errors DoContext tries something
+//  The zero Policy tries once
+type Policy struct {
+	// Backoff paces the attempts; nil retries immediately
+	Backoff Backoff
+	// MaxAttempts is how many times to try, including the first. Less than 1 is unlimited if MaxElapsed
+	//  is set, and once otherwise
+	MaxAttempts int
+	// MaxElapsed gives up once the next attempt would start this long after the first; 0 is unlimited
+	MaxElapsed time.Duration
+	// Retryable classifies errors, ex: to not retry a 4xx; nil retries every error
+	Retryable func(error) bool
+	// OnRetry is called after each failed attempt that will be retried, with its number (from 1), its
+	//  error, and the wait before the next
+	OnRetry func(attempt int, er error, wait time.Duration)
+	// Budget, if set, is told of each success, and must allow each retry
+	Budget *Budget
+}
+
+// Constant waits d between attempts
+func Constant(d time.Duration) Backoff {
+	return func(attempt int, previous time.Duration) time.Duration {
+		return d
+	}
+}
+
+// Linear waits <d * attempt> between attempts, as Do does
+func Linear(d time.Duration) Backoff {
+	return func(attempt int, previous time.Duration) time.Duration {
+		return d * time.Duration(attempt)
+	}
+}
+
+// Exponential waits base, doubling after each attempt, up to max (0 for no max)
+func Exponential(base, max time.Duration) Backoff {
+	return func(attempt int, previous time.Duration) time.Duration {
+		wait := base
+		for i := 1; i < attempt && wait < math.MaxInt64/2 && (max <= 0 || wait < max); i++ {
+			wait *= 2
+		}
+		if max > 0 && wait > max {
+			wait = max
+		}
+		return wait
+	}
+}
+
+// DecorrelatedJitter waits a random time between base and three times the previous wait, up to max
+//  (0 for no max), so clients retrying together spread out
+func DecorrelatedJitter(base, max time.Duration) Backoff {
+	return func(attempt int, previous time.Duration) time.Duration {
+		if previous < base {
+			previous = base
+		}
+		wait := base + jitter(previous*3-base)
+		if max > 0 && wait > max {
+			wait = max
+		}
+		return wait
+	}
+}
+
+var (
+	randMu sync.Mutex
+	random = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// jitter returns a random duration in [0, d]
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	randMu.Lock()
+	defer randMu.Unlock()
+	return time.Duration(random.Int63n(int64(d) + 1))
+}
+
+// Wait returns how long to wait before retry <attempt>, given the wait before the previous one
+func (p Policy) Wait(attempt int, previous time.Duration) time.Duration {
+	if p.Backoff == nil {
+		return 0
+	}
+	return p.Backoff(attempt, previous)
+}
+
+// Retries returns whether the policy retries er
+func (p Policy) Retries(er error) bool {
+	return p.Retryable == nil || p.Retryable(er)
+}
+
+// DoContext tries fn until it succeeds, paced and bounded by policy, returning its last error
+//  It stops early, returning that error, for an error the policy doesn't retry, when the policy's
+//  budget is spent, or once ctx is done (returning ctx's error if fn never ran)
+func DoContext(ctx context.Context, policy Policy, fn func() error) error {
+	startTime := time.Now()
+	var wait time.Duration
+	for attempt := 1; ; attempt++ {
+		if attempt == 1 && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		er := fn()
+		if er == nil && policy.Budget != nil {
+			policy.Budget.Deposit()
+		}
+		if er == nil || !policy.Retries(er) {
+			return er
+		}
+		if policy.MaxAttempts > 0 && attempt >= policy.MaxAttempts {
+			return er
+		}
+		if policy.MaxAttempts < 1 && policy.MaxElapsed <= 0 {
+			return er
+		}
+
+		wait = policy.Wait(attempt, wait)
+		if policy.MaxElapsed > 0 && time.Since(startTime)+wait > policy.MaxElapsed {
+			return er
+		}
+		if policy.Budget != nil && !policy.Budget.Withdraw() {
+			return er
+		}
+		if policy.OnRetry != nil {
+			policy.OnRetry(attempt, er, wait)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return er
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package retry
 
 import (
+	"context"
 	"errors"
 	"testing"
 	"time"
@@ -43,3 +44,188 @@ func TestDo(t *testing.T) {
 	})
 
 }
+
+func TestBackoffs(t *testing.T) {
+	Convey("Backoffs", t, func() {
+		Convey("constant", func() {
+			So(Constant(time.Second)(1, 0), ShouldEqual, time.Second)
+			So(Constant(time.Second)(5, time.Second), ShouldEqual, time.Second)
+		})
+
+		Convey("linear", func() {
+			So(Linear(time.Second)(1, 0), ShouldEqual, time.Second)
+			So(Linear(time.Second)(3, time.Second*2), ShouldEqual, time.Second*3)
+		})
+
+		Convey("exponential", func() {
+			b := Exponential(time.Second, time.Second*5)
+			So(b(1, 0), ShouldEqual, time.Second)
+			So(b(2, 0), ShouldEqual, time.Second*2)
+			So(b(3, 0), ShouldEqual, time.Second*4)
+			So(b(4, 0), ShouldEqual, time.Second*5)
+			So(b(100, 0), ShouldEqual, time.Second*5)
+			So(Exponential(time.Second, 0)(200, 0), ShouldBeGreaterThan, 0)
+		})
+
+		Convey("decorrelated jitter", func() {
+			b := DecorrelatedJitter(time.Millisecond*100, time.Second)
+			previous := time.Duration(0)
+			for attempt := 1; attempt < 50; attempt++ {
+				wait := b(attempt, previous)
+				So(wait, ShouldBeGreaterThanOrEqualTo, time.Millisecond*100)
+				So(wait, ShouldBeLessThanOrEqualTo, time.Second)
+				if previous > 0 {
+					So(wait, ShouldBeLessThanOrEqualTo, previous*3)
+				}
+				previous = wait
+			}
+		})
+	})
+}
+
+func TestDoContext(t *testing.T) {
+	Convey("DoContext", t, func() {
+		failing := errors.New("failed")
+
+		Convey("stops after max attempts", func() {
+			i := 0
+			attempts := make([]int, 0)
+			er := DoContext(context.Background(), Policy{
+				Backoff:     Constant(time.Millisecond),
+				MaxAttempts: 3,
+				OnRetry: func(attempt int, er error, wait time.Duration) {
+					attempts = append(attempts, attempt)
+				},
+			}, func() error {
+				i++
+				return failing
+			})
+			So(er, ShouldEqual, failing)
+			So(i, ShouldEqual, 3)
+			So(attempts, ShouldResemble, []int{1, 2})
+		})
+
+		Convey("succeeds eventually", func() {
+			i := 0
+			er := DoContext(context.Background(), Policy{Backoff: Linear(time.Millisecond), MaxAttempts: 5}, func() error {
+				i++
+				if i == 3 {
+					return nil
+				}
+				return failing
+			})
+			So(er, ShouldBeNil)
+			So(i, ShouldEqual, 3)
+		})
+
+		Convey("tries once with the zero policy", func() {
+			i := 0
+			So(DoContext(context.Background(), Policy{}, func() error {
+				i++
+				return failing
+			}), ShouldEqual, failing)
+			So(i, ShouldEqual, 1)
+		})
+
+		Convey("stops at errors that aren't retryable", func() {
+			permanent := errors.New("bad request")
+			i := 0
+			er := DoContext(context.Background(), Policy{
+				MaxAttempts: 5,
+				Retryable:   func(er error) bool { return !errors.Is(er, permanent) },
+			}, func() error {
+				i++
+				if i == 2 {
+					return permanent
+				}
+				return failing
+			})
+			So(er, ShouldEqual, permanent)
+			So(i, ShouldEqual, 2)
+		})
+
+		Convey("stops after max elapsed", func() {
+			i := 0
+			st := time.Now()
+			er := DoContext(context.Background(), Policy{Backoff: Constant(time.Millisecond * 40), MaxElapsed: time.Millisecond * 100}, func() error {
+				i++
+				return failing
+			})
+			So(er, ShouldEqual, failing)
+			So(i, ShouldEqual, 3)
+			So(time.Since(st), ShouldBeLessThan, time.Millisecond*100)
+		})
+
+		Convey("stops waiting when the context is done", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+			defer cancel()
+			i := 0
+			st := time.Now()
+			er := DoContext(ctx, Policy{Backoff: Constant(time.Second), MaxAttempts: 5}, func() error {
+				i++
+				return failing
+			})
+			So(er, ShouldEqual, failing)
+			So(i, ShouldEqual, 1)
+			So(time.Since(st), ShouldBeLessThan, time.Millisecond*500)
+
+			So(errors.Is(DoContext(ctx, Policy{}, func() error { return nil }), context.DeadlineExceeded), ShouldBeTrue)
+		})
+	})
+}
+
+func TestBudget(t *testing.T) {
+	Convey("Budget", t, func() {
+		b := NewBudget(0.5, 2)
+
+		Convey("starts with its reserve", func() {
+			So(b.Withdraw(), ShouldBeTrue)
+			So(b.Withdraw(), ShouldBeTrue)
+			So(b.Withdraw(), ShouldBeFalse)
+
+			Convey("and earns retries from successes", func() {
+				b.Deposit()
+				So(b.Withdraw(), ShouldBeFalse)
+				b.Deposit()
+				So(b.Withdraw(), ShouldBeTrue)
+				So(b.Stats(), ShouldResemble, BudgetStats{Successes: 2, Retries: 3, Denied: 2})
+			})
+		})
+
+		Convey("holds no more than its reserve", func() {
+			for i := 0; i < 100; i++ {
+				b.Deposit()
+			}
+			So(b.Withdraw(), ShouldBeTrue)
+			So(b.Withdraw(), ShouldBeTrue)
+			So(b.Withdraw(), ShouldBeFalse)
+		})
+
+		Convey("holds at least one retry", func() {
+			b := NewBudget(0.5, 0)
+			So(b.Withdraw(), ShouldBeTrue)
+			So(b.Withdraw(), ShouldBeFalse)
+			b.Deposit()
+			b.Deposit()
+			So(b.Withdraw(), ShouldBeTrue)
+		})
+
+		Convey("limits the retries of every policy sharing it", func() {
+			policy := Policy{MaxAttempts: 10, Budget: b}
+			calls := 0
+			failing := func() error {
+				calls++
+				return errors.New("outage")
+			}
+			So(DoContext(context.Background(), policy, failing), ShouldNotBeNil)
+			So(DoContext(context.Background(), policy, failing), ShouldNotBeNil)
+			So(calls, ShouldEqual, 4)
+
+			So(DoContext(context.Background(), policy, func() error { return nil }), ShouldBeNil)
+			So(DoContext(context.Background(), policy, func() error { return nil }), ShouldBeNil)
+			So(b.Stats().Successes, ShouldEqual, 2)
+			So(DoContext(context.Background(), policy, failing), ShouldNotBeNil)
+			So(calls, ShouldEqual, 6)
+		})
+	})
+}
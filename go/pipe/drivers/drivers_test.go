@@ -1,12 +1,25 @@
 package drivers
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/nochte/pipelinr-clients/go/lib"
+	"github.com/nochte/pipelinr-clients/go/lib/retry"
+	"github.com/nochte/pipelinr-protocol/protobuf/messages"
 	"github.com/nochte/pipelinr-protocol/protobuf/pipes"
 	. "github.com/smartystreets/goconvey/convey"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func TestDriver(t *testing.T) {
@@ -153,3 +166,410 @@ func TestDriver(t *testing.T) {
 		}
 	})
 }
+
+type flakyDriver struct {
+	Driver
+	failures int32
+}
+
+func (d *flakyDriver) Recv(receiveopts *pipes.ReceiveOptions) ([]*messages.Event, error) {
+	if atomic.AddInt32(&d.failures, -1) >= 0 {
+		return nil, errors.New("recv failed")
+	}
+	return d.Driver.Recv(receiveopts)
+}
+
+type streamingDriver struct {
+	*MemoryDriver
+	subscribed bool
+}
+
+func (d *streamingDriver) Subscribe(ctx context.Context, receiveopts *pipes.ReceiveOptions) (<-chan *messages.Event, <-chan error) {
+	d.subscribed = true
+	return NewPoller(d.MemoryDriver).Subscribe(ctx, receiveopts)
+}
+
+type fakeStreamer struct {
+	*MemoryDriver
+	unsupported bool
+	failures    int32
+	streams     int32
+}
+
+func (d *fakeStreamer) Stream(ctx context.Context, receiveopts *pipes.ReceiveOptions, push func(*messages.Event) bool) error {
+	atomic.AddInt32(&d.streams, 1)
+	if d.unsupported {
+		return ErrStreamUnsupported
+	}
+	if atomic.AddInt32(&d.failures, -1) >= 0 {
+		return errors.New("stream failed")
+	}
+	opts := *receiveopts
+	opts.Block, opts.Timeout = true, 1
+	for ctx.Err() == nil {
+		evts, er := d.Recv(&opts)
+		if er != nil {
+			return er
+		}
+		for _, evt := range evts {
+			if !push(evt) {
+				return ctx.Err()
+			}
+		}
+	}
+	return ctx.Err()
+}
+
+func TestMemoryDriver(t *testing.T) {
+	Convey("Memory driver", t, func() {
+		driver := NewMemoryDriver()
+		driver.SetTimeUnit(time.Millisecond * 10)
+		route := []string{lib.GenerateRandomString(8), lib.GenerateRandomString(8)}
+		id, er := driver.Send(`{"foo":"bar"}`, route)
+		So(er, ShouldBeNil)
+
+		Convey("redelivers un-acked messages after the redelivery timeout", func() {
+			opts := &pipes.ReceiveOptions{Pipe: route[0], Count: 1, RedeliveryTimeout: 5}
+			evts, er := driver.Recv(opts)
+			So(er, ShouldBeNil)
+			So(len(evts), ShouldEqual, 1)
+
+			evts, _ = driver.Recv(opts)
+			So(len(evts), ShouldEqual, 0)
+
+			opts.Block = true
+			opts.Timeout = 20
+			evts, _ = driver.Recv(opts)
+			So(len(evts), ShouldEqual, 1)
+			So(evts[0].GetStringId(), ShouldEqual, id)
+			So(driver.Deliveries(id, route[0]), ShouldEqual, 2)
+		})
+
+		Convey("routes completed messages to the next step", func() {
+			So(driver.AppendLog(id, route[0], -1, "failed once"), ShouldBeNil)
+			So(driver.Complete(id, route[0]), ShouldBeNil)
+			So(driver.Complete(id, route[0]), ShouldNotBeNil)
+
+			evts, er := driver.Recv(&pipes.ReceiveOptions{Pipe: route[1], Count: 1, Block: true, Timeout: 10})
+			So(er, ShouldBeNil)
+			So(len(evts), ShouldEqual, 1)
+			So(evts[0].GetMessage().GetCompletedSteps(), ShouldResemble, []string{route[0]})
+			So(evts[0].GetMessage().GetRouteLog()[0].GetCode(), ShouldEqual, -1)
+		})
+	})
+}
+
+func TestSubscribe(t *testing.T) {
+	Convey("Subscribe", t, func() {
+		driver := NewMemoryDriver()
+		driver.SetTimeUnit(time.Millisecond * 10)
+		step := lib.GenerateRandomString(8)
+		for i := 0; i < 5; i++ {
+			_, er := driver.Send(fmt.Sprintf(`{"num":%v}`, i), []string{step})
+			So(er, ShouldBeNil)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		Reset(cancel)
+
+		Convey("long-polls any driver until the context is done", func() {
+			events, errs := Subscribe(ctx, driver, &pipes.ReceiveOptions{Pipe: step, Count: 2, AutoAck: true})
+			for i := 0; i < 5; i++ {
+				evt := <-events
+				So(evt.GetMessage().GetPayload(), ShouldEqual, fmt.Sprintf(`{"num":%v}`, i))
+			}
+
+			cancel()
+			for range events {
+			}
+			_, open := <-errs
+			So(open, ShouldBeFalse)
+		})
+
+		Convey("buffers no more than Count events", func() {
+			events, _ := Subscribe(ctx, driver, &pipes.ReceiveOptions{Pipe: step, Count: 2, AutoAck: true})
+			time.Sleep(time.Millisecond * 50)
+			So(len(events), ShouldEqual, 2)
+			So(cap(events), ShouldEqual, 2)
+		})
+
+		Convey("reports failed recvs and keeps going", func() {
+			poller := NewPoller(&flakyDriver{Driver: driver, failures: 2})
+			poller.SetRetryPolicy(3, time.Millisecond)
+			events, errs := poller.Subscribe(ctx, &pipes.ReceiveOptions{Pipe: step, Count: 5, AutoAck: true})
+
+			So((<-errs).Error(), ShouldEqual, "recv failed")
+			for i := 0; i < 5; i++ {
+				<-events
+			}
+		})
+
+		Convey("ends on failed recvs its retry policy doesn't retry", func() {
+			poller := NewPoller(&flakyDriver{Driver: driver, failures: 5})
+			retries := 0
+			poller.SetRetry(retry.Policy{
+				Backoff:   retry.Constant(time.Millisecond),
+				Retryable: func(er error) bool { return retries < 1 },
+				OnRetry:   func(attempt int, er error, wait time.Duration) { retries++ },
+			})
+			events, errs := poller.Subscribe(ctx, &pipes.ReceiveOptions{Pipe: step, Count: 5, AutoAck: true})
+
+			for range events {
+			}
+			So((<-errs).Error(), ShouldEqual, "recv failed")
+			So(retries, ShouldEqual, 1)
+			So(poller.Stats().Errors, ShouldEqual, 2)
+		})
+
+		Convey("streams a Streamer, counting its streams and events", func() {
+			streamer := &fakeStreamer{MemoryDriver: driver}
+			poller := NewPoller(streamer)
+			events, _ := poller.Subscribe(ctx, &pipes.ReceiveOptions{Pipe: step, Count: 5, AutoAck: true})
+			for i := 0; i < 5; i++ {
+				<-events
+			}
+
+			So(atomic.LoadInt32(&streamer.streams), ShouldEqual, 1)
+			So(poller.Stats().Polls, ShouldEqual, 1)
+			So(poller.Stats().Events, ShouldEqual, 5)
+		})
+
+		Convey("reopens failed streams as its retry policy says", func() {
+			streamer := &fakeStreamer{MemoryDriver: driver, failures: 2}
+			poller := NewPoller(streamer)
+			attempts := make([]int, 0)
+			poller.SetRetry(retry.Policy{
+				Backoff: retry.Constant(time.Millisecond),
+				OnRetry: func(attempt int, er error, wait time.Duration) { attempts = append(attempts, attempt) },
+			})
+			events, errs := poller.Subscribe(ctx, &pipes.ReceiveOptions{Pipe: step, Count: 5, AutoAck: true})
+
+			So((<-errs).Error(), ShouldEqual, "stream failed")
+			for i := 0; i < 5; i++ {
+				<-events
+			}
+			So(attempts, ShouldResemble, []int{1, 2})
+			So(atomic.LoadInt32(&streamer.streams), ShouldEqual, 3)
+		})
+
+		Convey("backs off failed streams as far as the policy goes once its budget is spent", func() {
+			streamer := &fakeStreamer{MemoryDriver: driver, failures: 2}
+			poller := NewPoller(streamer)
+			budget := retry.NewBudget(0, 1)
+			attempts := make([]int, 0)
+			poller.SetRetry(retry.Policy{
+				Backoff:     retry.Linear(time.Millisecond),
+				MaxAttempts: 3,
+				Budget:      budget,
+				OnRetry:     func(attempt int, er error, wait time.Duration) { attempts = append(attempts, attempt) },
+			})
+			events, _ := poller.Subscribe(ctx, &pipes.ReceiveOptions{Pipe: step, Count: 5, AutoAck: true})
+
+			for i := 0; i < 5; i++ {
+				<-events
+			}
+			So(attempts, ShouldResemble, []int{1, 3})
+			So(budget.Stats(), ShouldResemble, retry.BudgetStats{Successes: 1, Retries: 1, Denied: 1})
+		})
+
+		Convey("backs off failed streams once its budget is spent, with unlimited attempts", func() {
+			streamer := &fakeStreamer{MemoryDriver: driver, failures: 2}
+			poller := NewPoller(streamer)
+			attempts := make([]int, 0)
+			poller.SetRetry(retry.Policy{
+				Backoff: retry.Exponential(time.Millisecond, time.Millisecond*20),
+				Budget:  retry.NewBudget(0, 1),
+				OnRetry: func(attempt int, er error, wait time.Duration) { attempts = append(attempts, attempt) },
+			})
+			events, _ := poller.Subscribe(ctx, &pipes.ReceiveOptions{Pipe: step, Count: 5, AutoAck: true})
+
+			for i := 0; i < 5; i++ {
+				<-events
+			}
+			So(attempts, ShouldResemble, []int{1, spentFailures})
+		})
+
+		Convey("ends on failed streams its retry policy doesn't retry", func() {
+			streamer := &fakeStreamer{MemoryDriver: driver, failures: 5}
+			poller := NewPoller(streamer)
+			poller.SetRetry(retry.Policy{
+				Backoff:   retry.Constant(time.Millisecond),
+				Retryable: func(er error) bool { return false },
+			})
+			events, errs := poller.Subscribe(ctx, &pipes.ReceiveOptions{Pipe: step, Count: 5, AutoAck: true})
+
+			for range events {
+			}
+			So((<-errs).Error(), ShouldEqual, "stream failed")
+			So(atomic.LoadInt32(&streamer.streams), ShouldEqual, 1)
+		})
+
+		Convey("polls a Streamer whose server can't stream, with its strategy", func() {
+			streamer := &fakeStreamer{MemoryDriver: driver, unsupported: true}
+			poller := NewPoller(streamer)
+			poller.SetStrategy(FixedInterval(time.Millisecond * 10))
+			events, _ := poller.Subscribe(ctx, &pipes.ReceiveOptions{Pipe: step, Count: 5, AutoAck: true})
+			for i := 0; i < 5; i++ {
+				<-events
+			}
+			time.Sleep(time.Millisecond * 100)
+
+			So(atomic.LoadInt32(&streamer.streams), ShouldEqual, 1)
+			So(poller.Stats().Events, ShouldEqual, 5)
+			So(poller.Stats().EmptyPolls, ShouldBeGreaterThan, 3)
+		})
+
+		Convey("prefers a driver's native subscription", func() {
+			native := &streamingDriver{MemoryDriver: driver}
+			events, _ := Subscribe(ctx, native, &pipes.ReceiveOptions{Pipe: step, Count: 5, AutoAck: true})
+			<-events
+			So(native.subscribed, ShouldBeTrue)
+		})
+	})
+}
+
+func TestPollStrategy(t *testing.T) {
+	Convey("Poll strategies", t, func() {
+		Convey("long poll blocks and never waits", func() {
+			opts := &pipes.ReceiveOptions{}
+			s := LongPoll(0)
+			s.Prepare(opts)
+			So(opts.GetBlock(), ShouldBeTrue)
+			So(opts.GetTimeout(), ShouldEqual, DefaultLongPollTimeout)
+			So(s.Wait(10, 0), ShouldEqual, 0)
+		})
+
+		Convey("fixed interval waits only after empty polls", func() {
+			opts := &pipes.ReceiveOptions{Block: true}
+			s := FixedInterval(time.Second)
+			s.Prepare(opts)
+			So(opts.GetBlock(), ShouldBeFalse)
+			So(s.Wait(10, 0), ShouldEqual, time.Second)
+			So(s.Wait(10, 3), ShouldEqual, 0)
+		})
+
+		Convey("exponential idle doubles up to max and resets on events", func() {
+			s := ExponentialIdle(time.Second, time.Second*5)
+			So(s.Wait(10, 0), ShouldEqual, time.Second)
+			So(s.Wait(10, 0), ShouldEqual, time.Second*2)
+			So(s.Wait(10, 0), ShouldEqual, time.Second*4)
+			So(s.Wait(10, 0), ShouldEqual, time.Second*5)
+			So(s.Wait(10, 1), ShouldEqual, 0)
+			So(s.Wait(10, 0), ShouldEqual, time.Second)
+		})
+
+		Convey("adaptive follows batch fullness and long-polls when idle", func() {
+			opts := &pipes.ReceiveOptions{}
+			s := Adaptive(time.Second, 20)
+			So(s.Wait(10, 10), ShouldEqual, 0)
+			So(s.Wait(10, 5), ShouldBeGreaterThan, 0)
+			s.Prepare(opts)
+			So(opts.GetBlock(), ShouldBeFalse)
+
+			for i := 0; i < 20; i++ {
+				s.Wait(10, 0)
+			}
+			s.Prepare(opts)
+			So(opts.GetBlock(), ShouldBeTrue)
+			So(opts.GetTimeout(), ShouldEqual, 20)
+			So(s.Wait(10, 0), ShouldEqual, 0)
+		})
+
+		Convey("poller counts empty polls", func() {
+			driver := NewMemoryDriver()
+			step := lib.GenerateRandomString(8)
+			driver.Send(`{}`, []string{step})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			poller := NewPoller(driver)
+			poller.SetStrategy(FixedInterval(time.Millisecond * 10))
+			events, _ := poller.Subscribe(ctx, &pipes.ReceiveOptions{Pipe: step, Count: 5, AutoAck: true})
+			<-events
+			time.Sleep(time.Millisecond * 100)
+
+			stats := poller.Stats()
+			So(stats.Events, ShouldEqual, 1)
+			So(stats.Errors, ShouldEqual, 0)
+			So(stats.EmptyPolls, ShouldBeGreaterThan, 3)
+			So(stats.Polls, ShouldBeGreaterThanOrEqualTo, stats.EmptyPolls+1)
+		})
+	})
+}
+
+func TestHTTPComplete(t *testing.T) {
+	Convey("HTTPDriver Complete", t, func() {
+		code, body := http.StatusOK, `{"status":200}`
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("content-type", "application/json")
+			w.WriteHeader(code)
+			w.Write([]byte(body))
+		}))
+		Reset(server.Close)
+		driver := NewHTTPDriver(server.URL, "key")
+
+		Convey("succeeds", func() {
+			So(driver.Complete("id", "step"), ShouldBeNil)
+		})
+
+		Convey("reports an already completed step", func() {
+			body = `{"status":409,"text":"already completed"}`
+			So(driver.Complete("id", "step"), ShouldEqual, ErrStepCompleted)
+			code, body = http.StatusConflict, `{}`
+			So(driver.Complete("id", "step"), ShouldEqual, ErrStepCompleted)
+		})
+
+		Convey("fails on any other status", func() {
+			body = `{"status":500,"text":"database down"}`
+			er := driver.Complete("id", "step")
+			So(er, ShouldNotEqual, ErrStepCompleted)
+			So(er.Error(), ShouldEqual, "complete failed with status 500: database down")
+
+			code, body = http.StatusUnauthorized, `{}`
+			er = driver.Complete("id", "step")
+			So(errors.Is(er, ErrStepCompleted), ShouldBeFalse)
+			So(er.Error(), ShouldStartWith, "complete failed with status 401")
+		})
+	})
+}
+
+type completeServer struct {
+	pipes.UnimplementedPipeServer
+	er error
+	ok bool
+}
+
+func (s *completeServer) Complete(ctx context.Context, req *pipes.CompleteRequest) (*pipes.GenericResponse, error) {
+	if s.er != nil {
+		return nil, s.er
+	}
+	return &pipes.GenericResponse{OK: s.ok}, nil
+}
+
+func TestGRPCComplete(t *testing.T) {
+	Convey("GRPCDriver Complete", t, func() {
+		listener, er := net.Listen("tcp", "127.0.0.1:0")
+		So(er, ShouldBeNil)
+		fake := &completeServer{ok: true}
+		server := grpc.NewServer()
+		pipes.RegisterPipeServer(server, fake)
+		go server.Serve(listener)
+		Reset(server.Stop)
+		driver := NewGRPCDriver(listener.Addr().String(), "key")
+
+		Convey("succeeds", func() {
+			So(driver.Complete("id", "step"), ShouldBeNil)
+		})
+
+		Convey("reports an already completed step", func() {
+			fake.ok = false
+			So(driver.Complete("id", "step"), ShouldEqual, ErrStepCompleted)
+		})
+
+		Convey("fails on a transport error", func() {
+			fake.er = status.Error(codes.Unavailable, "try again")
+			er := driver.Complete("id", "step")
+			So(errors.Is(er, ErrStepCompleted), ShouldBeFalse)
+			So(status.Code(er), ShouldEqual, codes.Unavailable)
+		})
+	})
+}
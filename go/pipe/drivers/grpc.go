@@ -3,13 +3,16 @@ package drivers
 import (
 	"context"
 	"errors"
+	"io"
 	"log"
 	"os"
 
 	"github.com/nochte/pipelinr-protocol/protobuf/messages"
 	"github.com/nochte/pipelinr-protocol/protobuf/pipes"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 type GRPCDriver struct {
@@ -34,8 +37,12 @@ func NewGRPCDriver(url, apikey string) *GRPCDriver {
 	opts = append(opts, grpc.WithUnaryInterceptor(
 		func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, handler grpc.UnaryInvoker, opts ...grpc.CallOption) error {
 			ctx = metadata.AppendToOutgoingContext(ctx, "authorization", apikey)
-			handler(ctx, method, req, reply, cc, opts...)
-			return nil
+			return handler(ctx, method, req, reply, cc, opts...)
+		}))
+	opts = append(opts, grpc.WithStreamInterceptor(
+		func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+			ctx = metadata.AppendToOutgoingContext(ctx, "authorization", apikey)
+			return streamer(ctx, desc, cc, method, opts...)
 		}))
 
 	conn, err := grpc.Dial(url, opts...)
@@ -71,6 +78,42 @@ func (d GRPCDriver) Recv(receiveopts *pipes.ReceiveOptions) ([]*messages.Event,
 	return evts.GetEvents(), nil
 }
 
+// Subscribe takes a context and set of receive options, returning a chan of events and a chan of errors
+//  Events are streamed with StreamRecv by a default Poller, falling back to long-polling Recv if the
+//  server doesn't implement it. A Pipe streams with its own Poller, see Stream
+func (d GRPCDriver) Subscribe(ctx context.Context, receiveopts *pipes.ReceiveOptions) (<-chan *messages.Event, <-chan error) {
+	return NewPoller(d).Subscribe(ctx, receiveopts)
+}
+
+// Stream hands the events from a single StreamRecv call to push, returning the error that ended it, or
+//  ErrStreamUnsupported if the server doesn't implement StreamRecv
+func (d GRPCDriver) Stream(ctx context.Context, receiveopts *pipes.ReceiveOptions, push func(*messages.Event) bool) error {
+	er := d.stream(ctx, receiveopts, push)
+	if status.Code(er) == codes.Unimplemented {
+		return ErrStreamUnsupported
+	}
+	return er
+}
+
+func (d GRPCDriver) stream(ctx context.Context, receiveopts *pipes.ReceiveOptions, push func(*messages.Event) bool) error {
+	stream, er := d.client.StreamRecv(ctx, receiveopts)
+	if er != nil {
+		return er
+	}
+	for {
+		evt, er := stream.Recv()
+		if er == io.EOF {
+			return errors.New("stream closed by server")
+		}
+		if er != nil {
+			return er
+		}
+		if !push(evt) {
+			return ctx.Err()
+		}
+	}
+}
+
 // Ack takes an id and a step, returning error on fail
 func (d GRPCDriver) Ack(id, step string) error {
 	_, er := d.client.Ack(context.Background(), &pipes.CompleteRequest{
@@ -89,8 +132,9 @@ func (d GRPCDriver) Complete(id, step string) error {
 	if er != nil {
 		return er
 	}
-	if !res.GetOK() {
-		return errors.New("step already completed")
+	if res != nil && !res.GetOK() {
+		// pipelinr answered, and declined to complete the step
+		return ErrStepCompleted
 	}
 	return nil
 }
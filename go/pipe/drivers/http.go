@@ -3,6 +3,7 @@ package drivers
 import (
 	"errors"
 	"fmt"
+	"net/http"
 	"os"
 	"strings"
 	"time"
@@ -121,20 +122,28 @@ func (d HTTPDriver) Ack(id, step string) error {
 	return er
 }
 
-// Complete takes an id and a step, return error on fail
+// Complete takes an id and a step, return error on fail, ErrStepCompleted if it was already completed
+//  (a 409 Conflict)
 func (d HTTPDriver) Complete(id, step string) error {
 	var result HTTPResponse
-	_, er := d.baseRequest().
+	res, er := d.baseRequest().
 		SetResult(&result).
 		Put(fmt.Sprintf("%v/api/2/message/%v/complete/%v", d.urlbase, id, step))
 
 	if er != nil {
 		return er
 	}
-	if result.Status != 200 {
-		return errors.New("step already completed")
+	status := result.Status
+	if !res.IsSuccess() {
+		status = res.StatusCode
 	}
-	return nil
+	switch status {
+	case http.StatusOK:
+		return nil
+	case http.StatusConflict:
+		return ErrStepCompleted
+	}
+	return fmt.Errorf("complete failed with status %v: %v", status, result.Text)
 }
 
 // AppendLog takes an id, step, code, and message, returning error on fail
@@ -1,10 +1,16 @@
 package drivers
 
 import (
+	"errors"
+
 	"github.com/nochte/pipelinr-protocol/protobuf/messages"
 	"github.com/nochte/pipelinr-protocol/protobuf/pipes"
 )
 
+// ErrStepCompleted is returned by Complete when the message's step was already completed, ex: by an
+//  earlier delivery of the same message
+var ErrStepCompleted = errors.New("step already completed")
+
 type Driver interface {
 	// Send takes at least a Payload and Route, returning the id of the message, error on fail
 	Send(payload string, route []string) (string, error)
@@ -12,7 +18,7 @@ type Driver interface {
 	Recv(receiveopts *pipes.ReceiveOptions) ([]*messages.Event, error)
 	// Ack takes an id and a step, returning error on fail
 	Ack(id, step string) error
-	// Complete takes an id and a step, return error on fail
+	// Complete takes an id and a step, return error on fail, ErrStepCompleted if it was already completed
 	Complete(id, step string) error
 	// AppendLog takes an id, step, code, and message, returning error on fail
 	AppendLog(id, step string, code int32, message string) error
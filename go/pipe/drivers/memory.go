@@ -0,0 +1,380 @@
+package drivers
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/amsokol/mongo-go-driver-protobuf/pmongo"
+	"github.com/nochte/pipelinr-protocol/protobuf/messages"
+	"github.com/nochte/pipelinr-protocol/protobuf/pipes"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// MemoryDriver is an in-process Driver, useful for tests and local development
+//  It routes messages between steps, and redelivers un-acked messages once their
+//  RedeliveryTimeout has elapsed, like pipelinr does
+type MemoryDriver struct {
+	mu       sync.Mutex
+	messages map[string]*memoryMessage
+	queues   map[string][]string
+	changed  chan struct{}
+	timeUnit time.Duration
+}
+
+type memoryMessage struct {
+	id           primitive.ObjectID
+	envelop      *messages.MessageEnvelop
+	eventType    messages.EventType
+	createdAt    time.Time
+	redeliverAt  map[string]time.Time
+	leases       map[string]time.Duration
+	deliveries   map[string]int
+	decorationAt map[string]int
+}
+
+const memoryDefaultRedeliveryTimeout = 60
+
+func NewMemoryDriver() *MemoryDriver {
+	return &MemoryDriver{
+		messages: make(map[string]*memoryMessage),
+		queues:   make(map[string][]string),
+		changed:  make(chan struct{}),
+		timeUnit: time.Second,
+	}
+}
+
+// SetTimeUnit sets the length of one unit of Timeout and RedeliveryTimeout, defaulting to a second
+//  Tests can shrink it to exercise long-polling and redelivery quickly
+func (d *MemoryDriver) SetTimeUnit(unit time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.timeUnit = unit
+}
+
+// Deliveries returns how many times the message has been delivered to step
+func (d *MemoryDriver) Deliveries(id, step string) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	m, ok := d.messages[id]
+	if !ok {
+		return 0
+	}
+	return m.deliveries[step]
+}
+
+// Message returns a copy of the message's envelop, nil if there is no such message
+func (d *MemoryDriver) Message(id string) *messages.MessageEnvelop {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	m, ok := d.messages[id]
+	if !ok {
+		return nil
+	}
+	return m.copyEnvelop()
+}
+
+// notify wakes any blocked Recv calls; d.mu must be held
+func (d *MemoryDriver) notify() {
+	close(d.changed)
+	d.changed = make(chan struct{})
+}
+
+// enqueue makes the message available to the first step of its route that is not completed; d.mu must be held
+func (d *MemoryDriver) enqueue(m *memoryMessage) {
+	for _, step := range m.envelop.GetRoute() {
+		if !m.completed(step) {
+			d.queues[step] = append(d.queues[step], m.id.Hex())
+			d.notify()
+			return
+		}
+	}
+}
+
+// Send takes at least a Payload and Route, returning the id of the message, error on fail
+func (d *MemoryDriver) Send(payload string, route []string) (string, error) {
+	if len(route) == 0 {
+		return "", errors.New("route must have at least 1 element")
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	m := &memoryMessage{
+		id: primitive.NewObjectID(),
+		envelop: &messages.MessageEnvelop{
+			Payload:          payload,
+			Route:            append([]string{}, route...),
+			DecoratedPayload: payload,
+		},
+		eventType:    messages.EventType_Created,
+		createdAt:    time.Now(),
+		redeliverAt:  make(map[string]time.Time),
+		leases:       make(map[string]time.Duration),
+		deliveries:   make(map[string]int),
+		decorationAt: make(map[string]int),
+	}
+	d.messages[m.id.Hex()] = m
+	d.enqueue(m)
+
+	return m.id.Hex(), nil
+}
+
+// Recv takes a set of receive options, returning an array of events, error on fail
+func (d *MemoryDriver) Recv(receiveopts *pipes.ReceiveOptions) ([]*messages.Event, error) {
+	d.mu.Lock()
+	deadline := time.Now().Add(time.Duration(receiveopts.GetTimeout()) * d.timeUnit)
+	for {
+		out := d.take(receiveopts)
+		if len(out) > 0 || !receiveopts.GetBlock() || !time.Now().Before(deadline) {
+			d.mu.Unlock()
+			return out, nil
+		}
+
+		changed := d.changed
+		wait := time.Until(deadline)
+		if next, ok := d.nextRedelivery(receiveopts.GetPipe()); ok && time.Until(next) < wait {
+			wait = time.Until(next)
+		}
+		d.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-time.After(wait):
+		}
+		d.mu.Lock()
+	}
+}
+
+// take removes up to receiveopts.Count available events from the pipe's queue; d.mu must be held
+func (d *MemoryDriver) take(receiveopts *pipes.ReceiveOptions) []*messages.Event {
+	step := receiveopts.GetPipe()
+	count := int(receiveopts.GetCount())
+	if count < 1 {
+		count = 1
+	}
+	redelivery := receiveopts.GetRedeliveryTimeout()
+	if redelivery <= 0 {
+		redelivery = memoryDefaultRedeliveryTimeout
+	}
+
+	now := time.Now()
+	out := make([]*messages.Event, 0, count)
+	queue := d.queues[step][:0]
+	for _, id := range d.queues[step] {
+		m, ok := d.messages[id]
+		if !ok || m.completed(step) {
+			continue
+		}
+		if len(out) == count || m.inflight(step, now) {
+			queue = append(queue, id)
+			continue
+		}
+
+		m.deliveries[step]++
+		if receiveopts.GetAutoAck() {
+			m.redeliverAt[step] = time.Time{}
+		} else {
+			m.leases[step] = time.Duration(redelivery) * d.timeUnit
+			m.redeliverAt[step] = now.Add(m.leases[step])
+			queue = append(queue, id)
+		}
+		out = append(out, m.event(receiveopts, now))
+	}
+	d.queues[step] = queue
+
+	return out
+}
+
+// nextRedelivery returns the earliest time an in-flight message on step becomes available again; d.mu must be held
+func (d *MemoryDriver) nextRedelivery(step string) (time.Time, bool) {
+	var next time.Time
+	for _, id := range d.queues[step] {
+		m, ok := d.messages[id]
+		if !ok {
+			continue
+		}
+		at := m.redeliverAt[step]
+		if !at.IsZero() && (next.IsZero() || at.Before(next)) {
+			next = at
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// Ack takes an id and a step, returning error on fail
+//  The memory driver treats an ack as a lease renewal, re-arming the message's redelivery timeout
+func (d *MemoryDriver) Ack(id, step string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	m, ok := d.messages[id]
+	if !ok {
+		return nil
+	}
+	if m.inflight(step, time.Now()) && !m.redeliverAt[step].IsZero() {
+		m.redeliverAt[step] = time.Now().Add(m.leases[step])
+	}
+	return nil
+}
+
+// Complete takes an id and a step, return error on fail
+func (d *MemoryDriver) Complete(id, step string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	m, ok := d.messages[id]
+	if !ok || m.completed(step) || !m.onRoute(step) {
+		return ErrStepCompleted
+	}
+	m.envelop.CompletedSteps = append(m.envelop.CompletedSteps, step)
+	m.eventType = messages.EventType_PipelineElementCompleted
+	delete(m.redeliverAt, step)
+	d.enqueue(m)
+	return nil
+}
+
+// AppendLog takes an id, step, code, and message, returning error on fail
+func (d *MemoryDriver) AppendLog(id, step string, code int32, message string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	m, ok := d.messages[id]
+	if !ok {
+		return errors.New("message not found")
+	}
+	m.envelop.RouteLog = append(m.envelop.RouteLog, &messages.RouteLog{
+		Step:    step,
+		Code:    code,
+		Message: message,
+		Time:    float64(time.Now().UnixNano()) / float64(time.Second),
+	})
+	return nil
+}
+
+// AddStepsAfter takes an id, step, and set of new steps, returning error on fail
+func (d *MemoryDriver) AddStepsAfter(id, after string, steps []string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	m, ok := d.messages[id]
+	if !ok {
+		return errors.New("message not found")
+	}
+	for ndx, step := range m.envelop.Route {
+		if step == after {
+			route := make([]string, 0, len(m.envelop.Route)+len(steps))
+			route = append(route, m.envelop.Route[:ndx+1]...)
+			route = append(route, steps...)
+			m.envelop.Route = append(route, m.envelop.Route[ndx+1:]...)
+			return nil
+		}
+	}
+	return errors.New("step not in route")
+}
+
+// Decorate takes an id and set of set of decorations, returning error on fail
+func (d *MemoryDriver) Decorate(id string, decorations []*pipes.Decoration) []error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	m, ok := d.messages[id]
+	if !ok {
+		return []error{errors.New("message not found")}
+	}
+	for _, dec := range decorations {
+		value := dec.GetValue()
+		if !json.Valid([]byte(value)) {
+			encoded, _ := json.Marshal(value)
+			value = string(encoded)
+		}
+		if ndx, ok := m.decorationAt[dec.GetKey()]; ok {
+			m.envelop.Decorations[ndx].Value = value
+			continue
+		}
+		m.decorationAt[dec.GetKey()] = len(m.envelop.Decorations)
+		m.envelop.Decorations = append(m.envelop.Decorations, &messages.Decoration{Key: dec.GetKey(), Value: value})
+	}
+
+	var payload map[string]interface{}
+	if json.Unmarshal([]byte(m.envelop.GetPayload()), &payload) == nil && payload != nil {
+		m.envelop.ApplyDecorations()
+	}
+	return make([]error, len(decorations))
+}
+
+// GetDecorations takes an id and set of keys, returning the decorations for each key (null on no-key)
+func (d *MemoryDriver) GetDecorations(id string, keys []string) ([]*pipes.Decoration, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	m, ok := d.messages[id]
+	if !ok {
+		return nil, errors.New("message not found")
+	}
+	out := make([]*pipes.Decoration, len(keys))
+	for ndx, key := range keys {
+		if at, ok := m.decorationAt[key]; ok {
+			out[ndx] = &pipes.Decoration{Key: key, Value: m.envelop.Decorations[at].GetValue()}
+		}
+	}
+	return out, nil
+}
+
+func (m *memoryMessage) completed(step string) bool {
+	for _, s := range m.envelop.GetCompletedSteps() {
+		if s == step {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *memoryMessage) onRoute(step string) bool {
+	for _, s := range m.envelop.GetRoute() {
+		if s == step {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *memoryMessage) inflight(step string, now time.Time) bool {
+	at, ok := m.redeliverAt[step]
+	if !ok {
+		return false
+	}
+	return at.IsZero() || at.After(now)
+}
+
+func (m *memoryMessage) copyEnvelop() *messages.MessageEnvelop {
+	out := &messages.MessageEnvelop{
+		Payload:          m.envelop.GetPayload(),
+		Route:            append([]string{}, m.envelop.GetRoute()...),
+		CompletedSteps:   append([]string{}, m.envelop.GetCompletedSteps()...),
+		DecoratedPayload: m.envelop.GetDecoratedPayload(),
+	}
+	for _, l := range m.envelop.GetRouteLog() {
+		out.RouteLog = append(out.RouteLog, &messages.RouteLog{Step: l.GetStep(), Code: l.GetCode(), Message: l.GetMessage(), Time: l.GetTime()})
+	}
+	for _, dec := range m.envelop.GetDecorations() {
+		out.Decorations = append(out.Decorations, &messages.Decoration{Key: dec.GetKey(), Value: dec.GetValue()})
+	}
+	return out
+}
+
+func (m *memoryMessage) event(receiveopts *pipes.ReceiveOptions, deliveredAt time.Time) *messages.Event {
+	envelop := m.copyEnvelop()
+	if receiveopts.GetExcludeRouting() {
+		envelop.Route = nil
+		envelop.CompletedSteps = nil
+	}
+	if receiveopts.GetExcludeRouteLog() {
+		envelop.RouteLog = nil
+	}
+	if receiveopts.GetExcludeDecoratedPayload() {
+		envelop.DecoratedPayload = ""
+	}
+	return &messages.Event{
+		Id:        pmongo.NewObjectId(m.id),
+		Message:   envelop,
+		Type:      m.eventType,
+		CreatedAt: timestamppb.New(m.createdAt),
+		UpdatedAt: timestamppb.New(deliveredAt),
+	}
+}
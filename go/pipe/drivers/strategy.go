@@ -0,0 +1,135 @@
+package drivers
+
+import (
+	"time"
+
+	"github.com/nochte/pipelinr-protocol/protobuf/pipes"
+)
+
+// PollStrategy decides how a Poller paces its Recv calls
+//  Strategies may keep state between calls, so an instance should only be used by one Poller
+type PollStrategy interface {
+	// Prepare adjusts the receive options before each Recv, ex: to switch between short and long polls
+	Prepare(receiveopts *pipes.ReceiveOptions)
+	// Wait takes how many events the last Recv requested and received, returning how long to wait before the next
+	Wait(requested, received int) time.Duration
+}
+
+// LongPoll returns a strategy that always blocks on the server for up to timeout seconds, and never waits
+//  between polls. A timeout of 0 uses the receive options' Timeout, or DefaultLongPollTimeout when unset
+func LongPoll(timeout int64) PollStrategy {
+	return &longPoll{timeout: timeout}
+}
+
+type longPoll struct {
+	timeout int64
+}
+
+func (s *longPoll) Prepare(receiveopts *pipes.ReceiveOptions) {
+	receiveopts.Block = true
+	if s.timeout > 0 {
+		receiveopts.Timeout = s.timeout
+	}
+	if receiveopts.Timeout <= 0 {
+		receiveopts.Timeout = DefaultLongPollTimeout
+	}
+}
+
+func (s *longPoll) Wait(requested, received int) time.Duration {
+	return 0
+}
+
+// FixedInterval returns a strategy that short-polls, waiting interval after any poll that came back empty
+func FixedInterval(interval time.Duration) PollStrategy {
+	return &fixedInterval{interval: interval}
+}
+
+type fixedInterval struct {
+	interval time.Duration
+}
+
+func (s *fixedInterval) Prepare(receiveopts *pipes.ReceiveOptions) {
+	receiveopts.Block = false
+}
+
+func (s *fixedInterval) Wait(requested, received int) time.Duration {
+	if received > 0 {
+		return 0
+	}
+	return s.interval
+}
+
+// ExponentialIdle returns a strategy that short-polls, waiting min after the first empty poll and
+//  doubling the wait with each consecutive empty poll up to max. Receiving any event resets the wait
+func ExponentialIdle(min, max time.Duration) PollStrategy {
+	return &exponentialIdle{min: min, max: max}
+}
+
+type exponentialIdle struct {
+	min  time.Duration
+	max  time.Duration
+	wait time.Duration
+}
+
+func (s *exponentialIdle) Prepare(receiveopts *pipes.ReceiveOptions) {
+	receiveopts.Block = false
+}
+
+func (s *exponentialIdle) Wait(requested, received int) time.Duration {
+	if received > 0 {
+		s.wait = 0
+		return 0
+	}
+	if s.wait == 0 {
+		s.wait = s.min
+	} else {
+		s.wait *= 2
+	}
+	if s.wait > s.max {
+		s.wait = s.max
+	}
+	return s.wait
+}
+
+// Adaptive returns a strategy driven by how full recent batches were
+//  Full batches are followed immediately by another poll, partially full ones by a wait proportional
+//  to how empty recent batches have been (up to max). Once the pipe looks idle it switches to long polls
+//  of timeout seconds, so an idle pipe costs one call per timeout rather than one per max
+func Adaptive(max time.Duration, timeout int64) PollStrategy {
+	return &adaptive{max: max, timeout: timeout, fullness: 1}
+}
+
+// adaptiveWeight is how much the latest batch counts toward the running fullness average
+const adaptiveWeight = 0.3
+
+// adaptiveIdle is the average fullness under which the pipe is considered idle
+const adaptiveIdle = 0.05
+
+type adaptive struct {
+	max      time.Duration
+	timeout  int64
+	fullness float64
+}
+
+func (s *adaptive) Prepare(receiveopts *pipes.ReceiveOptions) {
+	receiveopts.Block = s.fullness < adaptiveIdle
+	if receiveopts.Block {
+		receiveopts.Timeout = s.timeout
+		if receiveopts.Timeout <= 0 {
+			receiveopts.Timeout = DefaultLongPollTimeout
+		}
+	}
+}
+
+func (s *adaptive) Wait(requested, received int) time.Duration {
+	latest := 0.0
+	if requested > 0 {
+		latest = float64(received) / float64(requested)
+	}
+	s.fullness = s.fullness*(1-adaptiveWeight) + latest*adaptiveWeight
+
+	if received >= requested || s.fullness < adaptiveIdle {
+		return 0
+	}
+	return time.Duration(float64(s.max) * (1 - s.fullness))
+}
@@ -0,0 +1,283 @@
+package drivers
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/nochte/pipelinr-clients/go/lib/retry"
+	"github.com/nochte/pipelinr-protocol/protobuf/messages"
+	"github.com/nochte/pipelinr-protocol/protobuf/pipes"
+)
+
+// Subscriber is implemented by drivers whose transport can push events natively
+type Subscriber interface {
+	// Subscribe takes a context and set of receive options, returning a chan of events and a chan of
+	//  errors. Both chans are closed once the subscription has ended, which happens after ctx is done
+	Subscribe(ctx context.Context, receiveopts *pipes.ReceiveOptions) (<-chan *messages.Event, <-chan error)
+}
+
+// Streamer is implemented by drivers whose transport can push events natively, a stream at a time
+//  A Poller subscribing to one streams instead of polling, reconnecting as it would retry a Recv
+type Streamer interface {
+	// Stream hands each event for receiveopts.Pipe to push, which returns false once ctx is done, until
+	//  the stream ends, returning the error that ended it, or ErrStreamUnsupported if the server can't stream
+	Stream(ctx context.Context, receiveopts *pipes.ReceiveOptions, push func(*messages.Event) bool) error
+}
+
+// ErrStreamUnsupported is returned by a Streamer whose server can't stream, so it's polled instead
+var ErrStreamUnsupported = errors.New("streaming not supported by the server")
+
+// spentFailures is how many consecutive failures a Poller backs off for while its retry budget is
+//  spent, if its policy's MaxAttempts doesn't say, far enough for Exponential to reach a usual max
+const spentFailures = 10
+
+// Subscribe streams events for receiveopts.Pipe from driver until ctx is done
+//  Drivers implementing Subscriber are used natively, any other driver is long-polled with a Poller
+func Subscribe(ctx context.Context, driver Driver, receiveopts *pipes.ReceiveOptions) (<-chan *messages.Event, <-chan error) {
+	if sub, ok := driver.(Subscriber); ok {
+		return sub.Subscribe(ctx, receiveopts)
+	}
+	return NewPoller(driver).Subscribe(ctx, receiveopts)
+}
+
+// DefaultLongPollTimeout is the Timeout long-polling strategies use when the receive options don't set one
+//  It bounds how long a cancelled subscription can wait on an in-flight Recv
+const DefaultLongPollTimeout = 10
+
+// PollStats counts a Poller's Recv calls, or the streams it opened, for a Streamer
+type PollStats struct {
+	// Polls is the number of Recv calls made
+	Polls uint64
+	// EmptyPolls is the number of Recv calls that succeeded with no events
+	EmptyPolls uint64
+	// Events is the number of events received
+	Events uint64
+	// Errors is the number of Recv calls that failed
+	Errors uint64
+}
+
+// Poller implements Subscriber over any Driver with continuous Recv calls, paced by its PollStrategy
+//  which defaults to LongPoll. A Streamer is streamed, and only polled if its server can't stream
+//
+// Flow control: the events chan is buffered to receiveopts.Count, and each Recv only asks for as many
+//  events as there is room for in that buffer (at least 1). A slow consumer therefore holds at most
+//  Count+1 un-acked events client side, which should be accounted for in the RedeliveryTimeout
+type Poller struct {
+	stats    PollStats
+	driver   Driver
+	strategy PollStrategy
+	retry    retry.Policy
+}
+
+func NewPoller(driver Driver) *Poller {
+	return &Poller{
+		driver:   driver,
+		strategy: LongPoll(0),
+		retry:    retry.Policy{Backoff: retry.Linear(250 * time.Millisecond), MaxAttempts: 10},
+	}
+}
+
+// SetStrategy sets how the Poller paces its Recv calls; it should be called before Subscribe
+func (p *Poller) SetStrategy(strategy PollStrategy) {
+	p.strategy = strategy
+}
+
+// Stats returns a snapshot of the Poller's counters
+func (p *Poller) Stats() PollStats {
+	return PollStats{
+		Polls:      atomic.LoadUint64(&p.stats.Polls),
+		EmptyPolls: atomic.LoadUint64(&p.stats.EmptyPolls),
+		Events:     atomic.LoadUint64(&p.stats.Events),
+		Errors:     atomic.LoadUint64(&p.stats.Errors),
+	}
+}
+
+// SetRetryPolicy sets how a Poller waits after a failed Recv: <backoff * consecutive failures>,
+//  growing for up to attemptcount failures
+func (p *Poller) SetRetryPolicy(attemptcount int, backoff time.Duration) {
+	p.SetRetry(retry.Policy{Backoff: retry.Linear(backoff), MaxAttempts: attemptcount})
+}
+
+// SetRetry sets how a Poller waits after failed Recv calls, or streams: the policy's backoff for the
+//  number of consecutive failures, which stops growing at MaxAttempts, as a subscription doesn't give
+//  up. An error the policy doesn't retry ends the subscription. Successful Recv calls, and streams that
+//  deliver events, are deposited in the policy's budget, and while it is spent the Poller waits as long
+//  as it would after MaxAttempts failures, or after 10 with unlimited attempts. It should be called
+//  before Subscribe
+func (p *Poller) SetRetry(policy retry.Policy) {
+	p.retry = policy
+}
+
+// Subscribe takes a context and set of receive options, returning a chan of events and a chan of errors
+//  Failed Recv calls, or streams, are reported on the error chan when there is room for them, and
+//  retried after a backoff unless the retry policy says otherwise
+func (p *Poller) Subscribe(ctx context.Context, receiveopts *pipes.ReceiveOptions) (<-chan *messages.Event, <-chan error) {
+	opts := *receiveopts
+	if opts.Count < 1 {
+		opts.Count = 1
+	}
+
+	events := make(chan *messages.Event, opts.Count)
+	errs := make(chan error, 1)
+
+	go func() {
+		defer close(errs)
+		defer close(events)
+		if s, ok := p.driver.(Streamer); ok && !errors.Is(p.stream(ctx, s, &opts, events, errs), ErrStreamUnsupported) {
+			return
+		}
+		p.poll(ctx, &opts, events, errs)
+	}()
+
+	return events, errs
+}
+
+// stream pushes events from s into events until ctx is done, opening a new stream after a backoff
+//  each time one fails, or until one fails with an error the retry policy doesn't retry. It returns
+//  ErrStreamUnsupported as soon as s does, so the caller can poll
+func (p *Poller) stream(ctx context.Context, s Streamer, opts *pipes.ReceiveOptions, events chan *messages.Event, errs chan error) error {
+	b := backoff{}
+	for ctx.Err() == nil {
+		atomic.AddUint64(&p.stats.Polls, 1)
+		received := 0
+		er := s.Stream(ctx, opts, func(evt *messages.Event) bool {
+			if received == 0 {
+				// the stream is up, which counts as a success until it fails
+				p.succeeded(&b)
+			}
+			atomic.AddUint64(&p.stats.Events, 1)
+			received++
+			select {
+			case events <- evt:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+		if errors.Is(er, ErrStreamUnsupported) {
+			return er
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		if received == 0 {
+			atomic.AddUint64(&p.stats.EmptyPolls, 1)
+		}
+		atomic.AddUint64(&p.stats.Errors, 1)
+		if !p.failed(ctx, &b, er, errs) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// poll pushes events from continuous Recv calls into events until ctx is done, or until a Recv fails
+//  with an error the retry policy doesn't retry
+func (p *Poller) poll(ctx context.Context, opts *pipes.ReceiveOptions, events chan *messages.Event, errs chan error) {
+	b := backoff{}
+	for ctx.Err() == nil {
+		p.strategy.Prepare(opts)
+		opts.Count = int32(cap(events) - len(events))
+		if opts.Count < 1 {
+			opts.Count = 1
+		}
+
+		atomic.AddUint64(&p.stats.Polls, 1)
+		evts, er := p.driver.Recv(opts)
+		if er != nil {
+			atomic.AddUint64(&p.stats.Errors, 1)
+			if !p.failed(ctx, &b, er, errs) {
+				return
+			}
+			continue
+		}
+		p.succeeded(&b)
+		if len(evts) == 0 {
+			atomic.AddUint64(&p.stats.EmptyPolls, 1)
+		}
+		atomic.AddUint64(&p.stats.Events, uint64(len(evts)))
+
+		for _, evt := range evts {
+			// Recv asked for no more than there was room for, so this doesn't drop events fetched
+			//  just as ctx was done; a consumer draining the subscription still gets them
+			select {
+			case events <- evt:
+				continue
+			default:
+			}
+			select {
+			case events <- evt:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if !sleep(ctx, p.strategy.Wait(int(opts.Count), len(evts))) {
+			return
+		}
+	}
+}
+
+// backoff is a subscription's consecutive failures, and its last wait after one
+type backoff struct {
+	failures int
+	wait     time.Duration
+}
+
+// succeeded resets b after a successful Recv or stream, depositing it in the retry policy's budget
+func (p *Poller) succeeded(b *backoff) {
+	b.failures, b.wait = 0, 0
+	if p.retry.Budget != nil {
+		p.retry.Budget.Deposit()
+	}
+}
+
+// failed reports er, then waits as long as the retry policy says to after b's failures, returning
+//  false if the subscription is to end, as the policy doesn't retry er or ctx was done first
+func (p *Poller) failed(ctx context.Context, b *backoff, er error, errs chan error) bool {
+	if !p.retry.Retries(er) {
+		// make room, so the error that ended the subscription is the one reported
+		select {
+		case <-errs:
+		default:
+		}
+		errs <- er
+		return false
+	}
+	if p.retry.MaxAttempts < 1 || b.failures < p.retry.MaxAttempts {
+		b.failures++
+	}
+	if p.retry.Budget != nil && !p.retry.Budget.Withdraw() {
+		// there's no giving up, so back off as far as the policy goes
+		if p.retry.MaxAttempts > 0 {
+			b.failures = p.retry.MaxAttempts
+		} else if b.failures < spentFailures {
+			b.failures = spentFailures
+		}
+	}
+	b.wait = p.retry.Wait(b.failures, b.wait)
+	if p.retry.OnRetry != nil {
+		p.retry.OnRetry(b.failures, er, b.wait)
+	}
+	select {
+	case errs <- er:
+	default:
+	}
+	return sleep(ctx, b.wait)
+}
+
+// sleep waits for d, returning false if ctx was done first
+func sleep(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
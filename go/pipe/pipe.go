@@ -1,9 +1,12 @@
 package pipe
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"log"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/nochte/pipelinr-clients/go/lib/retry"
@@ -16,14 +19,32 @@ type Pipe struct {
 	driver         drivers.Driver
 	step           string
 	receiveOptions *pipes.ReceiveOptions
-	attemptCount   int
-	backoffMs      int
-	running        bool
-	stopped        bool
-	messages       chan *messages.Event
+	retryPolicy    retry.Policy
+	retryBudget    *retry.Budget
+	poller         *drivers.Poller
+
+	mu       sync.Mutex
+	running  bool
+	stopped  bool
+	paused   bool
+	pause    chan struct{}
+	resume   chan struct{}
+	cancel   context.CancelFunc
+	messages chan *messages.Event
+	done     chan struct{}
+	err      error
+
+	// unsubscribe ends the current subscription, so the next one picks up new receive options
+	unsubscribe context.CancelFunc
 }
 
 func New(driver drivers.Driver, step string) *Pipe {
+	policy := retry.Policy{Backoff: retry.Linear(250 * time.Millisecond), MaxAttempts: 10}
+	poller := drivers.NewPoller(driver)
+	poller.SetRetry(policy)
+	resume := make(chan struct{})
+	close(resume)
+
 	return &Pipe{
 		driver: driver,
 		step:   step,
@@ -38,12 +59,12 @@ func New(driver drivers.Driver, step string) *Pipe {
 			Timeout:                 0,
 			RedeliveryTimeout:       0,
 		},
-		attemptCount: 10,
-		backoffMs:    250,
-		running:      false,
-		stopped:      false,
-		// TODO: figure out the best way to transport this chan around
-		// messages:     make(chan *messages.Event, 10),
+		retryPolicy: policy,
+		poller:      poller,
+		running:     false,
+		pause:       make(chan struct{}),
+		resume:      resume,
+		done:        make(chan struct{}),
 	}
 }
 
@@ -55,31 +76,118 @@ func NewGRPC(url, apikey, step string) *Pipe {
 	return New(drivers.NewGRPCDriver(url, apikey), step)
 }
 
-func (p Pipe) Name() string {
+func (p *Pipe) Name() string {
 	return p.step
 }
 
-func (p Pipe) Step() string {
+func (p *Pipe) Step() string {
 	return p.step
 }
 
+// Stop stops the pipe, making Start return and closing Chan
+//  A pipe that is stopped before it is started will refuse to Start
 func (p *Pipe) Stop() {
-	p.running = false
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	p.stopped = true
-	if p.messages != nil {
-		close(p.messages)
+	if p.running {
+		p.cancel()
+		return
+	}
+	p.finish(nil)
+}
+
+// Pause stops the pipe fetching messages until Resume is called, without stopping it: messages already
+//  fetched, including by a long poll in flight when it was paused, are still delivered to Chan
+// A pipe paused before it is started starts paused
+func (p *Pipe) Pause() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.paused {
+		return
+	}
+	p.paused = true
+	p.resume = make(chan struct{})
+	close(p.pause)
+}
+
+// Resume has a paused pipe fetch messages again
+func (p *Pipe) Resume() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.paused {
+		return
+	}
+	p.paused = false
+	p.pause = make(chan struct{})
+	close(p.resume)
+}
+
+// Paused returns whether the pipe is paused
+func (p *Pipe) Paused() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.paused
+}
+
+// Reset readies a pipe whose Start has returned to be started again, with a new Chan and Done
+//  It returns an error if the pipe is running, or was stopped with Stop
+func (p *Pipe) Reset() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.running {
+		return errors.New("already running")
+	}
+	if p.stopped {
+		return errors.New("pipe stopped")
+	}
+	select {
+	case <-p.done:
+	default:
+		// never started
+		return nil
 	}
 	p.messages = nil
+	p.done = make(chan struct{})
+	p.err = nil
+	return nil
 }
 
-func (p Pipe) ReceiveOptions() *pipes.ReceiveOptions {
+func (p *Pipe) ReceiveOptions() *pipes.ReceiveOptions {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	return p.receiveOptions
 }
 
+// SetCount sets how many messages the pipe fetches at a time, and may be called while it runs: the
+//  current subscription is ended, once its fetched messages are delivered, and a new one started with
+//  the new Count
+func (p *Pipe) SetCount(count int32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if count < 1 || count == p.receiveOptions.GetCount() {
+		return
+	}
+	ro := *p.receiveOptions
+	ro.Count = count
+	p.receiveOptions = &ro
+	if p.unsubscribe != nil {
+		p.unsubscribe()
+	}
+}
+
 // SetReceiveOptions takes the receive options fields and overwrites what the pipe was using previously
 //  use nil for a value to indicate that the pipe should continue to use what it has
 func (p *Pipe) SetReceiveOptions(count *int32, timeout *int64, redeliveryTimeout *int64, autoAck, block, excludeRouting, excludeRouteLog, excludeDecoratedPayload *bool) {
-	ro := p.receiveOptions
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ro := *p.receiveOptions
 	if count != nil {
 		ro.Count = *count
 	}
@@ -105,16 +213,59 @@ func (p *Pipe) SetReceiveOptions(count *int32, timeout *int64, redeliveryTimeout
 		ro.ExcludeDecoratedPayload = *excludeDecoratedPayload
 	}
 
-	p.receiveOptions = ro
+	p.receiveOptions = &ro
 }
 
+// SetRetryPolicy has Send try up to attemptcount times, <backoffMs * attempt> milliseconds apart, and
+//  the pipe's poller back off the same way after failed Recv calls
 func (p *Pipe) SetRetryPolicy(attemptcount, backoffMs int) {
-	p.attemptCount = attemptcount
-	p.backoffMs = backoffMs
+	p.SetRetry(retry.Policy{Backoff: retry.Linear(time.Duration(backoffMs) * time.Millisecond), MaxAttempts: attemptcount})
+}
+
+// SetRetry sets how Send retries, and how the pipe's poller backs off after failed Recv calls, see
+//  drivers.Poller.SetRetry. It should be called before Start
+func (p *Pipe) SetRetry(policy retry.Policy) {
+	p.retryPolicy = policy
+	p.poller.SetRetry(p.policy())
+}
+
+// SetRetryBudget has the pipe's retries spend from budget, which is usually shared with other pipes
+//  and workers, unless the pipe's retry policy has a budget of its own. It should be called before Start
+func (p *Pipe) SetRetryBudget(budget *retry.Budget) {
+	p.retryBudget = budget
+	p.poller.SetRetry(p.policy())
+}
+
+// policy returns the pipe's retry policy, spending from its retry budget
+func (p *Pipe) policy() retry.Policy {
+	policy := p.retryPolicy
+	if policy.Budget == nil {
+		policy.Budget = p.retryBudget
+	}
+	return policy
+}
+
+// SetPollStrategy sets how the pipe paces its Recv calls when the driver has to be polled, see
+//  drivers.LongPoll (the default), drivers.FixedInterval, drivers.ExponentialIdle and drivers.Adaptive
+//  It should be called before Start
+func (p *Pipe) SetPollStrategy(strategy drivers.PollStrategy) {
+	p.poller.SetStrategy(strategy)
+}
+
+// PollStats returns the pipe's polling counters, ex: how many polls came back empty
+//  For a driver that streams, each stream opened counts as one poll, with every event it delivered,
+//  so a worker's Autoscale sees one long fetch per stream rather than one per receive
+func (p *Pipe) PollStats() drivers.PollStats {
+	return p.poller.Stats()
 }
 
 // Send takes a payload and route, and submits it to pipelinr, returning the id of the event or error on failure
-func (p Pipe) Send(payload string, route []string) (string, error) {
+func (p *Pipe) Send(payload string, route []string) (string, error) {
+	return p.SendContext(context.Background(), payload, route)
+}
+
+// SendContext is Send, retrying no longer than ctx allows
+func (p *Pipe) SendContext(ctx context.Context, payload string, route []string) (string, error) {
 	if payload == "" {
 		return "", errors.New("payload required")
 	}
@@ -123,27 +274,27 @@ func (p Pipe) Send(payload string, route []string) (string, error) {
 	}
 
 	var out string
-	er := retry.Do(func() error {
+	er := retry.DoContext(ctx, p.policy(), func() error {
 		res, er := p.driver.Send(payload, route)
 		out = res
 		return er
-	}, p.attemptCount, time.Duration(p.backoffMs))
+	})
 
 	return out, er
 }
 
 // Ack acknowledges a message on this pipe, returning error on failure
-func (p Pipe) Ack(id string) error {
+func (p *Pipe) Ack(id string) error {
 	return p.driver.Ack(id, p.step)
 }
 
 // Complete complets a message on this pipe, returning error on failure
-func (p Pipe) Complete(id string) error {
+func (p *Pipe) Complete(id string) error {
 	return p.driver.Complete(id, p.step)
 }
 
 // Log logs to a message with this pipe's step
-func (p Pipe) Log(id string, code int32, message string) error {
+func (p *Pipe) Log(id string, code int32, message string) error {
 	if message == "" {
 		return errors.New("message required")
 	}
@@ -152,7 +303,7 @@ func (p Pipe) Log(id string, code int32, message string) error {
 }
 
 // AddSteps adds steps to this message after the pipe's step
-func (p Pipe) AddSteps(id string, steps []string) error {
+func (p *Pipe) AddSteps(id string, steps []string) error {
 	if len(steps) == 0 {
 		return errors.New("steps must be a slice with length > 0")
 	}
@@ -163,7 +314,7 @@ func (p Pipe) AddSteps(id string, steps []string) error {
 // Decorate appends some decorations to a message
 //  Note that overwriting keys is allowed and encouraged, where the last
 //  Value written to the key will be what is presented later in the pipe
-func (p Pipe) Decorate(id string, decorations []*pipes.Decoration) []error {
+func (p *Pipe) Decorate(id string, decorations []*pipes.Decoration) []error {
 	if len(decorations) == 0 {
 		return []error{errors.New("decorations must be a slice with length > 0")}
 	}
@@ -175,7 +326,7 @@ func (p Pipe) Decorate(id string, decorations []*pipes.Decoration) []error {
 //  - ex: string type: `"some-string"`
 //  - ex: int type: `1`
 //  - ex: json type: `{"some":{"things":{"go":"here"}}}`
-func (p Pipe) GetDecorations(id string, keys []string) ([]*pipes.Decoration, error) {
+func (p *Pipe) GetDecorations(id string, keys []string) ([]*pipes.Decoration, error) {
 	if len(keys) == 0 {
 		return nil, errors.New("keys must be a slice with length > 0")
 	}
@@ -184,88 +335,181 @@ func (p Pipe) GetDecorations(id string, keys []string) ([]*pipes.Decoration, err
 }
 
 // Fetch will retrieve messages from this pipe with the pipes receive options
-func (p Pipe) Fetch() ([]*messages.Event, error) {
-	return p.driver.Recv(p.receiveOptions)
+func (p *Pipe) Fetch() ([]*messages.Event, error) {
+	return p.driver.Recv(p.ReceiveOptions())
 }
 
-func (p Pipe) fetchWithBackoff() ([]*messages.Event, error) {
-	startTime := time.Now()
-	iterations := 0
-
-	var out []*messages.Event
-	er := retry.Do(func() error {
-		if p.stopped {
-			out = nil
-			return nil
+// Subscribe streams messages from this pipe with the pipe's receive options until ctx is done
+//  Errors from the underlying transport are reported on the error chan; the subscription keeps retrying them
+//  A driver that streams does so through the pipe's poller, with its poll strategy, retry policy and stats
+func (p *Pipe) Subscribe(ctx context.Context) (<-chan *messages.Event, <-chan error) {
+	if _, streams := p.driver.(drivers.Streamer); !streams {
+		if sub, ok := p.driver.(drivers.Subscriber); ok {
+			return sub.Subscribe(ctx, p.ReceiveOptions())
 		}
-		if iterations > 0 && os.Getenv("PIPELINR_DEBUG") != "" {
-			log.Printf("trying %v, elapsed %v, iteration %v\n", p.step, time.Since(startTime), iterations)
-		}
-		iterations++
-		o, er := p.driver.Recv(p.receiveOptions)
-		if er != nil {
-			return er
-		}
-		if len(o) == 0 {
-			return errors.New("not found")
-		}
-		out = o
-		return nil
-	}, p.attemptCount, time.Duration(p.backoffMs))
-
-	return out, er
+	}
+	return p.poller.Subscribe(ctx, p.ReceiveOptions())
 }
 
-// Start starts a goroutine that fetches messages from pipelinr to be processed
-//  It will retrieve up to receiveOptions.Count number of messages and make them available
-//  in this pipe's Chan
-// If maxmessages is > 0, then this pipe will auto-stop when maxmessages has been reached
-//  which has no practical purpose beyond testing scenarios. Best not to use it in production
-// Start returns an error if the pipe is already running
-func (p *Pipe) Start(maxmessages int) error {
+// Start subscribes to pipelinr and makes the received messages available in this pipe's Chan
+//  Up to receiveOptions.Count messages are buffered in Chan at a time
+// Start blocks until ctx is done or the pipe is stopped, at which point Chan is closed. It returns
+//  nil when stopped with Stop, ctx's error otherwise, and an error if the pipe is already running or done
+func (p *Pipe) Start(ctx context.Context) error {
+	p.mu.Lock()
 	if p.running {
+		p.mu.Unlock()
 		return errors.New("already running")
 	}
-
+	select {
+	case <-p.done:
+		p.mu.Unlock()
+		return errors.New("pipe stopped")
+	default:
+	}
 	p.running = true
-	processedMessages := 0
-	startTime := time.Now()
+	parent := ctx
+	ctx, p.cancel = context.WithCancel(ctx)
+	out := p.messagesChan()
+	p.mu.Unlock()
+
+	er := p.subscribe(ctx, out)
+	if er == context.Canceled && parent.Err() == nil {
+		// stopped with Stop
+		er = nil
+	}
 
-	p.messages = make(chan *messages.Event, p.receiveOptions.GetCount())
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cancel()
+	p.running = false
+	p.finish(er)
+	return er
+}
 
-	for p.running {
-		if os.Getenv("PIPELINR_DEBUG") != "" {
-			log.Printf("%v pipe is not full, fetching some - enqueued %v - total processed %v\n", p.step, len(p.messages), processedMessages)
+// subscribe relays events to out until ctx is done, unsubscribing while the pipe is paused, and
+//  resubscribing when its Count changes
+func (p *Pipe) subscribe(ctx context.Context, out chan<- *messages.Event) error {
+	for {
+		p.mu.Lock()
+		pause, resume := p.pause, p.resume
+		p.mu.Unlock()
+
+		select {
+		case <-resume:
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 
-		evts, er := p.fetchWithBackoff()
-		if er != nil {
-			if os.Getenv("PIPELINR_DEBUG") != "" {
-				log.Printf("%v error on fetch wtih backoff: %v\n", p.step, er)
+		subctx, unsubscribe := context.WithCancel(ctx)
+		p.mu.Lock()
+		p.unsubscribe = unsubscribe
+		p.mu.Unlock()
+		go func() {
+			select {
+			case <-pause:
+				unsubscribe()
+			case <-subctx.Done():
 			}
-			time.Sleep(time.Second)
-
+		}()
+		// the subscription's events are relayed until it has ended, so none that were fetched are lost
+		events, errs := p.Subscribe(subctx)
+		er := p.relay(ctx, events, errs, out)
+		// ended by a pause or a new Count, rather than on its own
+		unsubscribed := subctx.Err() != nil
+		unsubscribe()
+
+		if unsubscribed && ctx.Err() == nil {
 			continue
 		}
+		return er
+	}
+}
 
-		for _, evt := range evts {
-			processedMessages++
-			p.messages <- evt
-		}
-
-		if maxmessages > 0 && processedMessages >= maxmessages {
-			log.Printf("%v processed through all messages in %v\n", p.step, time.Since(startTime))
-			p.Stop()
+// relay hands events from the subscription to out until ctx is done. If the subscription ends first,
+//  it returns an error wrapping the last one the subscription reported
+func (p *Pipe) relay(ctx context.Context, events <-chan *messages.Event, errs <-chan error, out chan<- *messages.Event) error {
+	var last error
+	for {
+		select {
+		case evt, ok := <-events:
+			if !ok {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				// the error that ended the subscription is sent before events is closed
+				select {
+				case er, ok := <-errs:
+					if ok {
+						last = er
+					}
+				default:
+				}
+				if last != nil {
+					return fmt.Errorf("subscription ended: %w", last)
+				}
+				return errors.New("subscription ended")
+			}
+			select {
+			case out <- evt:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		case er, ok := <-errs:
+			if ok {
+				last = er
+			}
+			if ok && os.Getenv("PIPELINR_DEBUG") != "" {
+				log.Printf("%v error on subscription: %v\n", p.step, er)
+			}
+			if !ok {
+				errs = nil
+			}
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 	}
-
-	return nil
 }
 
-// Chan returns the internal p.messages chan, such that the caller is able to process messages in sequence
-func (p *Pipe) Chan() chan *messages.Event {
-	for p.messages == nil {
-		time.Sleep(time.Millisecond * 10)
+// messagesChan returns p.messages, creating it if needed; p.mu must be held
+func (p *Pipe) messagesChan() chan *messages.Event {
+	if p.messages == nil {
+		p.messages = make(chan *messages.Event, p.receiveOptions.GetCount())
 	}
 	return p.messages
 }
+
+// finish closes Chan and Done, recording er as the pipe's Err; p.mu must be held
+func (p *Pipe) finish(er error) {
+	select {
+	case <-p.done:
+		return
+	default:
+	}
+	p.err = er
+	close(p.messagesChan())
+	close(p.done)
+}
+
+// Chan returns the chan that Start delivers messages to, such that the caller is able to process them
+//  in sequence. It is closed once the pipe is done
+func (p *Pipe) Chan() <-chan *messages.Event {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.messagesChan()
+}
+
+// Done returns a chan that is closed once the pipe has stopped and Chan has been closed
+func (p *Pipe) Done() <-chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.done
+}
+
+// Err returns why the pipe stopped: nil while running or when stopped with Stop, otherwise the
+//  error that ended Start
+func (p *Pipe) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
@@ -1,12 +1,15 @@
 package pipe
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/nochte/pipelinr-clients/go/lib"
+	"github.com/nochte/pipelinr-clients/go/lib/retry"
 	"github.com/nochte/pipelinr-clients/go/pipe/drivers"
 	"github.com/nochte/pipelinr-protocol/protobuf/messages"
 	"github.com/nochte/pipelinr-protocol/protobuf/pipes"
@@ -113,7 +116,7 @@ func TestPipe(t *testing.T) {
 						i64sixty := int64(60)
 						p.SetReceiveOptions(&i32ten, &i64ten, &i64sixty, nil, nil, nil, nil, nil)
 
-						go p.Start(0)
+						go p.Start(context.Background())
 					}
 
 					Reset(func() {
@@ -161,7 +164,7 @@ func TestPipe(t *testing.T) {
 					for i := 0; i < pipecount; i++ {
 						p := New(driver, fmt.Sprintf("%v-bigstep-%v", pipenamebase, i))
 						p.SetReceiveOptions(&i32fifty, nil, &i64ten, nil, nil, nil, nil, nil)
-						go p.Start(0)
+						go p.Start(context.Background())
 
 						ppipes = append(ppipes, p)
 					}
@@ -258,3 +261,250 @@ func TestPipe(t *testing.T) {
 		}
 	})
 }
+
+func TestPipeLifecycle(t *testing.T) {
+	Convey("Pipe lifecycle", t, func() {
+		driver := drivers.NewMemoryDriver()
+		driver.SetTimeUnit(time.Millisecond * 10)
+		step := lib.GenerateRandomString(8)
+		pipe := New(driver, step)
+		i32five := int32(5)
+		tru := true
+		pipe.SetReceiveOptions(&i32five, nil, nil, &tru, nil, nil, nil, nil)
+
+		Convey("Start returns when its context ends, closing Chan", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			started := make(chan error)
+			go func() { started <- pipe.Start(ctx) }()
+
+			id, _ := pipe.Send(`{"foo":"bar"}`, []string{step})
+			So((<-pipe.Chan()).GetStringId(), ShouldEqual, id)
+			So(pipe.Start(ctx), ShouldNotBeNil)
+
+			cancel()
+			So(<-started, ShouldEqual, context.Canceled)
+			<-pipe.Done()
+			So(pipe.Err(), ShouldEqual, context.Canceled)
+			_, open := <-pipe.Chan()
+			So(open, ShouldBeFalse)
+			So(pipe.Start(context.Background()), ShouldNotBeNil)
+
+			Convey("and can be Reset to start again", func() {
+				So(pipe.Reset(), ShouldBeNil)
+				// let the last subscription's long poll end, so it can't take the next message
+				time.Sleep(time.Millisecond * 150)
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				go pipe.Start(ctx)
+
+				id, _ := pipe.Send(`{"foo":"bar"}`, []string{step})
+				So((<-pipe.Chan()).GetStringId(), ShouldEqual, id)
+				So(pipe.Reset(), ShouldNotBeNil)
+			})
+		})
+
+		Convey("Stop ends Start cleanly", func() {
+			started := make(chan error)
+			go func() { started <- pipe.Start(context.Background()) }()
+			pipe.Send(`{"foo":"bar"}`, []string{step})
+			<-pipe.Chan()
+			pipe.Stop()
+			So(<-started, ShouldBeNil)
+			So(pipe.Err(), ShouldBeNil)
+			So(pipe.Reset(), ShouldNotBeNil)
+		})
+
+		Convey("Stop before Start closes Chan", func() {
+			pipe.Stop()
+			_, open := <-pipe.Chan()
+			So(open, ShouldBeFalse)
+			So(pipe.Start(context.Background()), ShouldNotBeNil)
+		})
+
+		Convey("concurrent Start, Stop and Chan don't race", func() {
+			for i := 0; i < 50; i++ {
+				pipe.Send(fmt.Sprintf(`{"num":%v}`, i), []string{step})
+			}
+
+			wg := sync.WaitGroup{}
+			for i := 0; i < 4; i++ {
+				wg.Add(2)
+				go func() {
+					defer wg.Done()
+					pipe.Start(context.Background())
+				}()
+				go func() {
+					defer wg.Done()
+					for range pipe.Chan() {
+					}
+				}()
+			}
+			time.Sleep(time.Millisecond * 20)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				pipe.Stop()
+			}()
+			pipe.Stop()
+			wg.Wait()
+			<-pipe.Done()
+		})
+	})
+}
+
+func TestPipePause(t *testing.T) {
+	Convey("Pipe pause", t, func() {
+		driver := drivers.NewMemoryDriver()
+		driver.SetTimeUnit(time.Millisecond * 10)
+		step := lib.GenerateRandomString(8)
+		pipe := New(driver, step)
+		i32five := int32(5)
+		pipe.SetReceiveOptions(&i32five, nil, nil, nil, nil, nil, nil, nil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		Reset(cancel)
+		received := func() *messages.Event {
+			select {
+			case msg := <-pipe.Chan():
+				return msg
+			case <-time.After(time.Millisecond * 200):
+				return nil
+			}
+		}
+
+		Convey("stops fetching until resumed", func() {
+			go pipe.Start(ctx)
+			first, _ := pipe.Send(`{"foo":"bar"}`, []string{step})
+			So(received().GetStringId(), ShouldEqual, first)
+
+			pipe.Pause()
+			So(pipe.Paused(), ShouldBeTrue)
+			// let the long poll in flight end
+			time.Sleep(time.Millisecond * 150)
+			second, _ := pipe.Send(`{"foo":"bar"}`, []string{step})
+			So(received(), ShouldBeNil)
+			So(driver.Deliveries(second, step), ShouldEqual, 0)
+
+			pipe.Resume()
+			So(pipe.Paused(), ShouldBeFalse)
+			So(received().GetStringId(), ShouldEqual, second)
+		})
+
+		Convey("starts paused if paused first", func() {
+			pipe.Pause()
+			go pipe.Start(ctx)
+			id, _ := pipe.Send(`{"foo":"bar"}`, []string{step})
+			So(received(), ShouldBeNil)
+
+			pipe.Resume()
+			So(received().GetStringId(), ShouldEqual, id)
+		})
+
+		Convey("can be stopped while paused", func() {
+			pipe.Pause()
+			started := make(chan error)
+			go func() { started <- pipe.Start(ctx) }()
+			time.Sleep(time.Millisecond * 20)
+			pipe.Stop()
+			So(<-started, ShouldBeNil)
+		})
+	})
+}
+
+func TestPipeSetCount(t *testing.T) {
+	Convey("Pipe SetCount", t, func() {
+		driver := drivers.NewMemoryDriver()
+		driver.SetTimeUnit(time.Millisecond * 10)
+		step := lib.GenerateRandomString(8)
+		pipe := New(driver, step)
+		tru := true
+		pipe.SetReceiveOptions(nil, nil, nil, &tru, nil, nil, nil, nil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		Reset(cancel)
+		go pipe.Start(ctx)
+
+		first, _ := pipe.Send(`{"foo":"bar"}`, []string{step})
+		So((<-pipe.Chan()).GetStringId(), ShouldEqual, first)
+
+		pipe.SetCount(5)
+		So(pipe.ReceiveOptions().GetCount(), ShouldEqual, 5)
+		ids := make([]string, 0)
+		for i := 0; i < 10; i++ {
+			id, _ := pipe.Send(`{"foo":"bar"}`, []string{step})
+			ids = append(ids, id)
+		}
+		received := make([]string, 0)
+		for range ids {
+			received = append(received, (<-pipe.Chan()).GetStringId())
+		}
+		So(received, ShouldResemble, ids)
+
+		// the options the subscription was started with are left as they were
+		opts := pipe.ReceiveOptions()
+		timeout := int64(7)
+		pipe.SetReceiveOptions(nil, &timeout, nil, nil, nil, nil, nil, nil)
+		So(pipe.ReceiveOptions().GetTimeout(), ShouldEqual, 7)
+		So(opts.GetTimeout(), ShouldNotEqual, 7)
+	})
+}
+
+// grpcLike subscribes like the gRPC driver against a server that can't stream
+type grpcLike struct {
+	*drivers.MemoryDriver
+}
+
+func (d grpcLike) Subscribe(ctx context.Context, receiveopts *pipes.ReceiveOptions) (<-chan *messages.Event, <-chan error) {
+	return drivers.NewPoller(d).Subscribe(ctx, receiveopts)
+}
+
+func (d grpcLike) Stream(ctx context.Context, receiveopts *pipes.ReceiveOptions, push func(*messages.Event) bool) error {
+	return drivers.ErrStreamUnsupported
+}
+
+func TestPipeStreamer(t *testing.T) {
+	Convey("Pipe with a driver that streams", t, func() {
+		driver := drivers.NewMemoryDriver()
+		driver.SetTimeUnit(time.Millisecond * 10)
+		step := lib.GenerateRandomString(8)
+		pipe := New(grpcLike{driver}, step)
+		tru := true
+		pipe.SetReceiveOptions(nil, nil, nil, &tru, nil, nil, nil, nil)
+		pipe.SetPollStrategy(drivers.FixedInterval(time.Millisecond * 10))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		Reset(cancel)
+		go pipe.Start(ctx)
+
+		id, _ := pipe.Send(`{"foo":"bar"}`, []string{step})
+		So((<-pipe.Chan()).GetStringId(), ShouldEqual, id)
+		time.Sleep(time.Millisecond * 100)
+
+		stats := pipe.PollStats()
+		So(stats.Events, ShouldEqual, 1)
+		So(stats.EmptyPolls, ShouldBeGreaterThan, 3)
+	})
+}
+
+// refusingDriver fails every Recv with errRefused
+type refusingDriver struct {
+	*drivers.MemoryDriver
+}
+
+var errRefused = errors.New("refused")
+
+func (d refusingDriver) Recv(receiveopts *pipes.ReceiveOptions) ([]*messages.Event, error) {
+	return nil, errRefused
+}
+
+func TestPipeSubscriptionError(t *testing.T) {
+	Convey("Pipe whose subscription ends on an error", t, func() {
+		pipe := New(refusingDriver{drivers.NewMemoryDriver()}, lib.GenerateRandomString(8))
+		pipe.SetRetry(retry.Policy{Retryable: func(er error) bool { return false }})
+
+		er := pipe.Start(context.Background())
+		So(errors.Is(er, errRefused), ShouldBeTrue)
+		So(er.Error(), ShouldEqual, "subscription ended: refused")
+		So(errors.Is(pipe.Err(), errRefused), ShouldBeTrue)
+	})
+}
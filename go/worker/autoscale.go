@@ -0,0 +1,214 @@
+package worker
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/nochte/pipelinr-clients/go/pipe/drivers"
+)
+
+// Autoscale bounds a worker that tunes its own concurrency and receive Count as it runs
+//  Concurrency is raised one at a time while the handlers are kept busy, halved when they get slower
+//  than TargetLatency or fail more often than MaxErrorRate, and lowered one at a time while they idle
+//  Each pipe's Count is doubled while its fetches come back full, and halved while they come back
+//  mostly empty. A stream counts as one fetch, so a streaming pipe's Count is only adjusted in an
+//  interval where a stream was opened, by all the events the interval delivered
+type Autoscale struct {
+	MinConcurrency int
+	MaxConcurrency int
+	MinCount       int32
+	MaxCount       int32
+	// TargetLatency is the handler latency above which concurrency is cut, ex: when a downstream is
+	//  saturated; 0 ignores latency
+	TargetLatency time.Duration
+	// MaxErrorRate is the share of messages failing above which concurrency is cut; 0 ignores errors
+	MaxErrorRate float64
+	// Interval is how often the worker adjusts, defaulting to 5 seconds
+	Interval time.Duration
+}
+
+const (
+	// scaleUpUtilization is how busy the handlers must be kept for concurrency to be raised
+	scaleUpUtilization = 0.8
+	// scaleDownUtilization is how idle the handlers must be for concurrency to be lowered
+	scaleDownUtilization = 0.3
+	// fullBatch and emptyBatch are how full a pipe's fetches must be for its Count to be doubled or halved
+	fullBatch  = 0.8
+	emptyBatch = 0.2
+)
+
+// SetAutoscale has the worker tune its concurrency and its pipes' Count within a's bounds while it
+//  runs, starting from the concurrency and Count it has. It should be called before Run
+func (w *Worker) SetAutoscale(a Autoscale) {
+	if a.MinConcurrency < 1 {
+		a.MinConcurrency = 1
+	}
+	if a.MaxConcurrency < a.MinConcurrency {
+		a.MaxConcurrency = a.MinConcurrency
+	}
+	if a.MinCount < 1 {
+		a.MinCount = 1
+	}
+	if a.MaxCount < a.MinCount {
+		a.MaxCount = a.MinCount
+	}
+	if a.Interval <= 0 {
+		a.Interval = 5 * time.Second
+	}
+	w.autoscale = &a
+}
+
+// Concurrency returns how many messages the worker handles at once, which changes as it autoscales
+func (w *Worker) Concurrency() int {
+	w.mu.Lock()
+	l := w.limiter
+	w.mu.Unlock()
+	if l == nil {
+		return w.concurrency
+	}
+	return l.current()
+}
+
+// limiter caps how many handlers run at once, at a limit that can change while they run
+type limiter struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	limit  int
+	active int
+
+	// the current window's measurements, for autoscaling
+	handled int
+	failed  int
+	busy    time.Duration
+}
+
+func newLimiter(limit int) *limiter {
+	l := &limiter{limit: limit}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+func (l *limiter) acquire() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for l.active >= l.limit {
+		l.cond.Wait()
+	}
+	l.active++
+}
+
+func (l *limiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	l.cond.Signal()
+}
+
+func (l *limiter) current() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+func (l *limiter) setLimit(limit int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit = limit
+	l.cond.Broadcast()
+}
+
+// observe records a handled message
+func (l *limiter) observe(elapsed time.Duration, failed bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.handled++
+	l.busy += elapsed
+	if failed {
+		l.failed++
+	}
+}
+
+// window returns the measurements since it was last called, and the current limit
+func (l *limiter) window() (handled, failed int, busy time.Duration, limit int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	handled, failed, busy = l.handled, l.failed, l.busy
+	l.handled, l.failed, l.busy = 0, 0, 0
+	return handled, failed, busy, l.limit
+}
+
+// runAutoscale adjusts l's limit and the pipes' Count every interval until ctx is done
+func (w *Worker) runAutoscale(ctx context.Context, l *limiter) {
+	a := w.autoscale
+	last := make([]drivers.PollStats, len(w.pipes))
+	for ndx := range w.pipes {
+		last[ndx] = w.pipes[ndx].PollStats()
+	}
+
+	ticker := time.NewTicker(a.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		handled, failed, busy, limit := l.window()
+		l.setLimit(a.nextConcurrency(handled, failed, busy, limit))
+
+		for ndx, p := range w.pipes {
+			stats := p.PollStats()
+			polls := stats.Polls - last[ndx].Polls
+			events := stats.Events - last[ndx].Events
+			last[ndx] = stats
+			if polls > 0 {
+				p.SetCount(a.nextCount(p.ReceiveOptions().GetCount(), float64(events)/float64(polls)))
+			}
+		}
+	}
+}
+
+// nextConcurrency returns the concurrency to use after a window with the given measurements
+func (a *Autoscale) nextConcurrency(handled, failed int, busy time.Duration, limit int) int {
+	next := limit
+	utilization := float64(busy) / float64(a.Interval*time.Duration(limit))
+	switch {
+	case handled > 0 && a.MaxErrorRate > 0 && float64(failed)/float64(handled) > a.MaxErrorRate:
+		next = limit / 2
+	case handled > 0 && a.TargetLatency > 0 && busy/time.Duration(handled) > a.TargetLatency:
+		next = limit / 2
+	case utilization >= scaleUpUtilization:
+		next = limit + 1
+	case utilization < scaleDownUtilization:
+		next = limit - 1
+	}
+
+	if next < a.MinConcurrency {
+		next = a.MinConcurrency
+	}
+	if next > a.MaxConcurrency {
+		next = a.MaxConcurrency
+	}
+	return next
+}
+
+// nextCount returns the Count to use after fetches that averaged perPoll events
+func (a *Autoscale) nextCount(count int32, perPoll float64) int32 {
+	next := count
+	switch fullness := perPoll / float64(count); {
+	case fullness >= fullBatch:
+		next = count * 2
+	case fullness < emptyBatch:
+		next = count / 2
+	}
+
+	if next < a.MinCount {
+		next = a.MinCount
+	}
+	if next > a.MaxCount {
+		next = a.MaxCount
+	}
+	return next
+}
@@ -0,0 +1,93 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nochte/pipelinr-clients/go/pipe"
+	"github.com/nochte/pipelinr-protocol/protobuf/messages"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAutoscale(t *testing.T) {
+	Convey("Autoscale", t, func() {
+		a := Autoscale{
+			MinConcurrency: 1,
+			MaxConcurrency: 8,
+			MinCount:       1,
+			MaxCount:       16,
+			TargetLatency:  time.Millisecond * 100,
+			MaxErrorRate:   0.5,
+			Interval:       time.Second,
+		}
+
+		Convey("raises concurrency while the handlers are kept busy", func() {
+			So(a.nextConcurrency(40, 0, time.Millisecond*3600, 4), ShouldEqual, 5)
+			So(a.nextConcurrency(80, 0, time.Millisecond*8000, 8), ShouldEqual, 8)
+		})
+
+		Convey("lowers it while they idle", func() {
+			So(a.nextConcurrency(2, 0, time.Millisecond*100, 4), ShouldEqual, 3)
+			So(a.nextConcurrency(0, 0, 0, 1), ShouldEqual, 1)
+		})
+
+		Convey("halves it when they're slow or failing", func() {
+			So(a.nextConcurrency(10, 0, time.Millisecond*4000, 4), ShouldEqual, 2)
+			So(a.nextConcurrency(40, 30, time.Millisecond*3600, 4), ShouldEqual, 2)
+		})
+
+		Convey("sizes Count by how full fetches are", func() {
+			So(a.nextCount(4, 4), ShouldEqual, 8)
+			So(a.nextCount(16, 16), ShouldEqual, 16)
+			So(a.nextCount(4, 2), ShouldEqual, 4)
+			So(a.nextCount(4, 0.5), ShouldEqual, 2)
+		})
+	})
+}
+
+func TestWorkerAutoscale(t *testing.T) {
+	Convey("Worker autoscaling", t, func() {
+		driver := newCountingDriver()
+		w := newMemoryWorker(driver, 1)
+		w.SetAutoscale(Autoscale{
+			MinConcurrency: 1,
+			MaxConcurrency: 4,
+			MinCount:       1,
+			MaxCount:       8,
+			MaxErrorRate:   0.5,
+			Interval:       time.Millisecond * 50,
+		})
+		for i := 0; i < 200; i++ {
+			driver.Send(`{}`, []string{w.Step()})
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		Reset(cancel)
+
+		Convey("scales up under load", func() {
+			w.OnMessage(func(msg *messages.Event, p *pipe.Pipe) error {
+				time.Sleep(time.Millisecond * 10)
+				return nil
+			})
+			go w.Run(ctx)
+
+			So(eventually(func() bool { return w.Concurrency() == 4 }), ShouldBeTrue)
+			So(eventually(func() bool { return w.Pipe().ReceiveOptions().GetCount() > 1 }), ShouldBeTrue)
+		})
+
+		Convey("scales down when handlers fail", func() {
+			w.SetConcurrency(4)
+			w.SetFailureAction(ActionComplete)
+			w.OnMessage(func(msg *messages.Event, p *pipe.Pipe) error {
+				time.Sleep(time.Millisecond * 10)
+				return errors.New("downstream is down")
+			})
+			go w.Run(ctx)
+
+			So(eventually(func() bool { return w.Concurrency() == 4 }), ShouldBeTrue)
+			So(eventually(func() bool { return w.Concurrency() == 1 }), ShouldBeTrue)
+		})
+	})
+}
@@ -0,0 +1,169 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultBatchIdleTimeout is how long a batch waits for messages when BatchOptions doesn't say
+const DefaultBatchIdleTimeout = 30 * time.Second
+
+// BatchOptions decide when RunBatch stops: whichever of its limits is reached first
+type BatchOptions struct {
+	// IdleTimeout stops the batch once no message has been handled, and none has been in flight, for
+	//  this long; defaults to DefaultBatchIdleTimeout
+	IdleTimeout time.Duration
+	// MaxMessages stops the batch once this many messages have been handled; 0 is unlimited
+	//  Messages fetched beyond it are left for redelivery
+	MaxMessages int
+	// MaxDuration stops the batch once it has run this long, plus the drain timeout; 0 is unlimited
+	MaxDuration time.Duration
+}
+
+// BatchReason is why a batch stopped
+type BatchReason int
+
+const (
+	// BatchIdle batches ran out of messages
+	BatchIdle BatchReason = iota
+	// BatchMaxMessages batches handled their MaxMessages
+	BatchMaxMessages
+	// BatchMaxDuration batches ran for their MaxDuration
+	BatchMaxDuration
+	// BatchStopped batches were stopped by their context or Stop, or by their pipe stopping
+	BatchStopped
+)
+
+func (r BatchReason) String() string {
+	switch r {
+	case BatchIdle:
+		return "idle"
+	case BatchMaxMessages:
+		return "max messages"
+	case BatchMaxDuration:
+		return "max duration"
+	case BatchStopped:
+		return "stopped"
+	}
+	return "unknown"
+}
+
+// BatchSummary is what a batch did
+type BatchSummary struct {
+	Reason  BatchReason
+	Elapsed time.Duration
+	// Stats counts what happened during the batch
+	Stats Stats
+}
+
+func (s BatchSummary) String() string {
+	return fmt.Sprintf("handled %v messages in %v (%v completed, %v failed, %v dead-lettered, %v left), stopped: %v",
+		s.Stats.Handled, s.Elapsed.Round(time.Millisecond), s.Stats.Completed, s.Stats.Failed, s.Stats.DeadLettered, s.Stats.Left, s.Reason)
+}
+
+// batch counts the messages a batch has taken towards its MaxMessages, and those it is handling
+type batch struct {
+	max      int64
+	taken    int64
+	active   int64
+	full     chan struct{}
+	fullOnce sync.Once
+}
+
+// take returns whether another message fits in the batch; a nil batch is unlimited
+func (b *batch) take() bool {
+	if b == nil {
+		return true
+	}
+	taken := atomic.AddInt64(&b.taken, 1)
+	if b.max > 0 && taken >= b.max {
+		b.fullOnce.Do(func() { close(b.full) })
+		if taken > b.max {
+			return false
+		}
+	}
+	atomic.AddInt64(&b.active, 1)
+	return true
+}
+
+// done records that a message taken has been handled
+func (b *batch) done() {
+	if b != nil {
+		atomic.AddInt64(&b.active, -1)
+	}
+}
+
+// inFlight returns how many messages are being handled
+func (b *batch) inFlight() int64 {
+	return atomic.LoadInt64(&b.active)
+}
+
+// RunBatch runs the worker until its pipes have been idle for opts.IdleTimeout, or it has handled
+//  opts.MaxMessages, or run for opts.MaxDuration, then shuts it down as Run does and returns what it did
+//  ex: to run a step as a cron job, or a job that scales to zero
+// The error is Run's: nil on a clean shutdown
+func (w *Worker) RunBatch(ctx context.Context, opts BatchOptions) (BatchSummary, error) {
+	if opts.IdleTimeout <= 0 {
+		opts.IdleTimeout = DefaultBatchIdleTimeout
+	}
+	startTime := time.Now()
+	before := w.Stats()
+
+	runctx, stop := context.WithCancel(ctx)
+	defer stop()
+	var deadline <-chan time.Time
+	if opts.MaxDuration > 0 {
+		timer := time.NewTimer(opts.MaxDuration)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	b := &batch{max: int64(opts.MaxMessages), full: make(chan struct{})}
+	ran := make(chan error, 1)
+	go func() {
+		ran <- w.run(runctx, b)
+	}()
+
+	reason := BatchStopped
+	tick := opts.IdleTimeout / 10
+	if tick < 10*time.Millisecond {
+		tick = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	lastActive, lastHandled := time.Now(), before.Handled
+
+	var er error
+	running := true
+	for running {
+		select {
+		case er = <-ran:
+			return w.summary(reason, startTime, before), er
+		case <-b.full:
+			reason, running = BatchMaxMessages, false
+		case <-deadline:
+			reason, running = BatchMaxDuration, false
+		case <-ticker.C:
+			if handled := w.Stats().Handled; handled != lastHandled || b.inFlight() > 0 {
+				lastActive, lastHandled = time.Now(), handled
+			} else if time.Since(lastActive) >= opts.IdleTimeout {
+				reason, running = BatchIdle, false
+			}
+		}
+	}
+
+	stop()
+	er = <-ran
+	return w.summary(reason, startTime, before), er
+}
+
+func (w *Worker) summary(reason BatchReason, startTime time.Time, before Stats) BatchSummary {
+	return BatchSummary{
+		Reason:  reason,
+		Elapsed: time.Since(startTime),
+		Stats:   w.Stats().sub(before),
+	}
+}
@@ -0,0 +1,202 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nochte/pipelinr-clients/go/pipe"
+	"github.com/nochte/pipelinr-protocol/protobuf/messages"
+)
+
+// BatchHandler handles messages from p together, ex: to write them to a database in one statement
+//  It returns an Outcome for each message, in the order given, so the worker can complete the ones
+//  that succeeded and fail, retry or leave only the rest
+type BatchHandler func(ctx context.Context, msgs []*messages.Event, p *pipe.Pipe) []Outcome
+
+// OnBatch has the worker hand messages to h, up to size at a time, instead of running the onMessage
+//  chain for each one. A batch is handed over once it is full, or window after its first message
+//  arrived, whichever is first. Each batch holds one of the worker's concurrency slots, and only has
+//  messages from one pipe. Middleware doesn't wrap h. The receive options' Count should be at least
+//  size to fill a batch. It should be called before Run
+func (w *Worker) OnBatch(h BatchHandler, size int, window time.Duration) {
+	if size < 1 {
+		size = 1
+	}
+	w.batchHandler = h
+	w.batchSize = size
+	w.batchWindow = window
+}
+
+// consumeBatches is consume for a worker with a BatchHandler, collecting batches from ch until it is
+//  closed, and handling up to the limiter's limit of them at a time
+func (w *Worker) consumeBatches(s *session, ch <-chan delivery) {
+	wg := sync.WaitGroup{}
+	for open := true; open; {
+		var ds []delivery
+		ds, open = w.collect(ch)
+		if len(ds) == 0 {
+			break
+		}
+		s.limiter.acquire()
+		wg.Add(1)
+		go func(ds []delivery) {
+			defer wg.Done()
+			defer s.limiter.release()
+			if s.abandoned() {
+				for _, d := range ds {
+					d.release()
+				}
+				return
+			}
+			for p, grouped := range w.group(s, ds) {
+				w.handleBatch(s, grouped, p)
+			}
+		}(ds)
+	}
+	wg.Wait()
+}
+
+// collect receives up to the batch size of deliveries from ch, waiting no more than the batch window
+//  after the first. It returns false once ch is closed
+func (w *Worker) collect(ch <-chan delivery) ([]delivery, bool) {
+	d, ok := <-ch
+	if !ok {
+		return nil, false
+	}
+	ds := []delivery{d}
+
+	timer := time.NewTimer(w.batchWindow)
+	defer timer.Stop()
+	for len(ds) < w.batchSize {
+		select {
+		case d, ok := <-ch:
+			if !ok {
+				return ds, false
+			}
+			ds = append(ds, d)
+		case <-timer.C:
+			return ds, true
+		}
+	}
+	return ds, true
+}
+
+// group splits deliveries by the pipe they came from, dropping any that don't fit in the session's batch
+func (w *Worker) group(s *session, ds []delivery) map[*pipe.Pipe][]delivery {
+	out := make(map[*pipe.Pipe][]delivery)
+	for _, d := range ds {
+		if s.batch.take() {
+			out[d.pipe] = append(out[d.pipe], d)
+		} else {
+			d.release()
+		}
+	}
+	return out
+}
+
+// handleBatch runs the BatchHandler for deliveries from p, then acts on each one's outcome, handing
+//  the messages to retry after a delay back to it together. The batch's deadline runs from when its
+//  first message was taken from p
+func (w *Worker) handleBatch(s *session, ds []delivery, p *pipe.Pipe) {
+	deliveredAt := ds[0].at
+	pending := make([]*messages.Event, 0, len(ds))
+	leases := make(map[*messages.Event]func(), len(ds))
+	for _, d := range ds {
+		msg := d.msg
+		atomic.AddUint64(&w.stats.Handled, 1)
+		if w.duplicate(d) {
+			s.batch.done()
+			continue
+		}
+		if failures := w.failures(msg, p); w.maxFailures > 0 && failures >= w.maxFailures {
+			w.deadLetter(s, msg, p, w.maxFailureStep, LogCodeRouted, fmt.Sprintf("dead-lettered after %v failures at step %v", failures, p.Step()), d.release)
+			s.batch.done()
+			continue
+		}
+		pending = append(pending, msg)
+		leases[msg] = d.release
+	}
+	if len(pending) == 0 {
+		return
+	}
+
+	ctx, cancel := w.batchContext(s.ctx, p, deliveredAt)
+	defer cancel()
+	defer func() {
+		for _, msg := range pending {
+			leases[msg]()
+			s.batch.done()
+		}
+	}()
+
+	var elapsed time.Duration
+	for retries := 0; ; retries++ {
+		startTime := time.Now()
+		outcomes := w.callBatch(ctx, pending, p)
+		elapsed += time.Since(startTime)
+
+		retry := make([]*messages.Event, 0)
+		var delay time.Duration
+		for ndx, msg := range pending {
+			outcome, attempt := outcomes[ndx], 0
+			if outcome.Action != ActionComplete && ctx.Err() == context.DeadlineExceeded {
+				outcome = w.timedOut(ctx, msg, p, outcome)
+			} else {
+				outcome, attempt = w.scheduleRetry(msg, p, outcome, retries)
+			}
+			if outcome.Action == ActionRetry && outcome.Delay > 0 {
+				atomic.AddUint64(&w.stats.Retried, 1)
+				w.log(msg, p, LogCodeFailed, w.retryMessage(outcome, attempt))
+				w.notifyError(msg, p, outcome.Err)
+				retry = append(retry, msg)
+				if outcome.Delay > delay {
+					delay = outcome.Delay
+				}
+				continue
+			}
+
+			s.limiter.observe(elapsed/time.Duration(len(pending)), outcome.Err != nil)
+			w.apply(s, msg, p, outcome, leases[msg])
+			s.batch.done()
+		}
+		pending = retry
+		if len(pending) == 0 {
+			return
+		}
+
+		if !s.pause(ctx, delay) {
+			// past their deadline, or shutting down, they're left for pipelinr to redeliver
+			return
+		}
+	}
+}
+
+// callBatch runs the BatchHandler, failing every message if it panics or doesn't return an outcome for each
+func (w *Worker) callBatch(ctx context.Context, msgs []*messages.Event, p *pipe.Pipe) (outcomes []Outcome) {
+	defer func() {
+		if r := recover(); r != nil {
+			outcomes = w.failAll(w.recovered(r), len(msgs))
+		}
+	}()
+	outcomes = w.batchHandler(ctx, msgs, p)
+	if len(outcomes) != len(msgs) {
+		return w.failAll(Fail(fmt.Errorf("batch handler returned %v outcomes for %v messages", len(outcomes), len(msgs))), len(msgs))
+	}
+	for ndx := range outcomes {
+		outcomes[ndx].handler = batchSource
+	}
+	return outcomes
+}
+
+// failAll returns outcome, from the BatchHandler, n times
+func (w *Worker) failAll(outcome Outcome, n int) []Outcome {
+	outcome.handler = batchSource
+	out := make([]Outcome, n)
+	for ndx := range out {
+		out[ndx] = outcome
+	}
+	return out
+}
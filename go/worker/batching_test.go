@@ -0,0 +1,134 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nochte/pipelinr-clients/go/pipe"
+	"github.com/nochte/pipelinr-protocol/protobuf/messages"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/tidwall/gjson"
+)
+
+func TestWorkerOnBatch(t *testing.T) {
+	Convey("Worker with a batch handler", t, func() {
+		driver := newCountingDriver()
+		w := newMemoryWorker(driver, 10)
+		w.SetFailureAction(ActionLeave)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		Reset(cancel)
+
+		mu := sync.Mutex{}
+		sizes := make([]int, 0)
+		attempts := make(map[string]int)
+		w.OnBatch(func(ctx context.Context, msgs []*messages.Event, p *pipe.Pipe) []Outcome {
+			mu.Lock()
+			defer mu.Unlock()
+			sizes = append(sizes, len(msgs))
+			outcomes := make([]Outcome, 0, len(msgs))
+			for _, msg := range msgs {
+				attempts[msg.GetStringId()]++
+				switch {
+				case gjson.Get(msg.GetMessage().GetPayload(), "bad").Bool():
+					outcomes = append(outcomes, Fail(errors.New("bad row")))
+				case gjson.Get(msg.GetMessage().GetPayload(), "flaky").Bool() && attempts[msg.GetStringId()] == 1:
+					outcomes = append(outcomes, RetryAfter(time.Millisecond*20, errors.New("deadlock")))
+				default:
+					outcomes = append(outcomes, Completed())
+				}
+			}
+			return outcomes
+		}, 5, time.Millisecond*50)
+
+		Convey("hands over full batches, and completes only the successes", func() {
+			ids := make([]string, 0)
+			for i := 0; i < 10; i++ {
+				payload := `{}`
+				if i == 3 {
+					payload = `{"bad":true}`
+				}
+				id, _ := driver.Send(payload, []string{w.Step()})
+				ids = append(ids, id)
+			}
+			go w.Run(ctx)
+
+			So(eventually(func() bool { return w.Stats().Handled == 10 && w.Stats().Completed == 9 }), ShouldBeTrue)
+			So(w.Stats().Failed, ShouldEqual, 1)
+			So(driver.Completes(ids[3]), ShouldEqual, 0)
+			So(driver.Completes(ids[4]), ShouldEqual, 1)
+			mu.Lock()
+			defer mu.Unlock()
+			So(sizes, ShouldResemble, []int{5, 5})
+			So(driver.Message(ids[3]).GetRouteLog()[0].GetMessage(), ShouldEqual, "failed to run batch handler, with error bad row")
+		})
+
+		Convey("hands over partial batches after the window", func() {
+			go w.Run(ctx)
+			first, _ := driver.Send(`{}`, []string{w.Step()})
+			second, _ := driver.Send(`{}`, []string{w.Step()})
+
+			So(eventually(func() bool { return driver.Completes(first) == 1 && driver.Completes(second) == 1 }), ShouldBeTrue)
+			mu.Lock()
+			defer mu.Unlock()
+			total := 0
+			for _, size := range sizes {
+				total += size
+			}
+			So(total, ShouldEqual, 2)
+		})
+
+		Convey("retries only the messages that asked to", func() {
+			flaky, _ := driver.Send(`{"flaky":true}`, []string{w.Step()})
+			steady, _ := driver.Send(`{}`, []string{w.Step()})
+			go w.Run(ctx)
+
+			So(eventually(func() bool { return driver.Completes(flaky) == 1 && driver.Completes(steady) == 1 }), ShouldBeTrue)
+			So(w.Stats().Retried, ShouldEqual, 1)
+			mu.Lock()
+			defer mu.Unlock()
+			So(attempts[flaky], ShouldEqual, 2)
+			So(attempts[steady], ShouldEqual, 1)
+		})
+
+		Convey("handles other batches while one waits to retry", func() {
+			w.SetConcurrency(1)
+			w.OnBatch(func(ctx context.Context, msgs []*messages.Event, p *pipe.Pipe) []Outcome {
+				mu.Lock()
+				defer mu.Unlock()
+				outcomes := make([]Outcome, 0, len(msgs))
+				for _, msg := range msgs {
+					attempts[msg.GetStringId()]++
+					if gjson.Get(msg.GetMessage().GetPayload(), "flaky").Bool() && attempts[msg.GetStringId()] == 1 {
+						outcomes = append(outcomes, RetryAfter(time.Millisecond*300, errors.New("deadlock")))
+					} else {
+						outcomes = append(outcomes, Completed())
+					}
+				}
+				return outcomes
+			}, 1, time.Millisecond*10)
+			flaky, _ := driver.Send(`{"flaky":true}`, []string{w.Step()})
+			steady, _ := driver.Send(`{}`, []string{w.Step()})
+			go w.Run(ctx)
+
+			So(eventually(func() bool { return driver.Completes(steady) == 1 }), ShouldBeTrue)
+			So(driver.Completes(flaky), ShouldEqual, 0)
+			So(eventually(func() bool { return driver.Completes(flaky) == 1 }), ShouldBeTrue)
+		})
+
+		Convey("fails every message when the outcomes don't match", func() {
+			w.OnBatch(func(ctx context.Context, msgs []*messages.Event, p *pipe.Pipe) []Outcome {
+				return []Outcome{Completed()}
+			}, 5, time.Millisecond*50)
+			driver.Send(`{}`, []string{w.Step()})
+			driver.Send(`{}`, []string{w.Step()})
+			go w.Run(ctx)
+
+			So(eventually(func() bool { return w.Stats().Failed == 2 }), ShouldBeTrue)
+			So(w.Stats().Completed, ShouldEqual, 0)
+		})
+	})
+}
@@ -0,0 +1,150 @@
+package worker
+
+import (
+	"sync"
+
+	"github.com/nochte/pipelinr-clients/go/lib/retry"
+	"github.com/nochte/pipelinr-clients/go/pipe"
+	"github.com/nochte/pipelinr-protocol/protobuf/messages"
+)
+
+// AsyncCompletion has a worker log successes and complete messages in the background, so a slow
+//  pipelinr API doesn't hold up its handlers. Failures and retries are still logged as they happen, and
+//  routed messages have their next steps added before they are queued. Zero fields take their defaults
+type AsyncCompletion struct {
+	// Workers is how many goroutines complete messages, defaulting to 4
+	Workers int
+	// BatchSize is how many queued completions each goroutine takes at once, and makes concurrently,
+	//  defaulting to 1. pipelinr has no bulk endpoint, so a batch is as many calls, in parallel
+	BatchSize int
+	// QueueSize is how many completions may wait before handling blocks until there is room, defaulting
+	//  to 1000
+	QueueSize int
+	// Retry is how each call is retried; the zero Policy uses the worker's, see SetAPIRetry
+	Retry retry.Policy
+	// SuppressSuccessLog skips the "completed step" route log entry, halving the calls per message
+	SuppressSuccessLog bool
+}
+
+// SetAsyncCompletion has the worker complete messages in the background, configured by a. A stopping
+//  worker finishes the queued completions within its drain timeout. It should be called before Run
+func (w *Worker) SetAsyncCompletion(a AsyncCompletion) {
+	if a.Workers < 1 {
+		a.Workers = 4
+	}
+	if a.BatchSize < 1 {
+		a.BatchSize = 1
+	}
+	if a.QueueSize < 1 {
+		a.QueueSize = 1000
+	}
+	w.completion = &a
+}
+
+// CompletionBacklog returns how many completions are queued, 0 unless the worker completes asynchronously
+func (w *Worker) CompletionBacklog() int {
+	w.mu.Lock()
+	c := w.completer
+	w.mu.Unlock()
+	if c == nil {
+		return 0
+	}
+	return len(c.queue)
+}
+
+// completion is a message waiting to be logged and completed
+type completion struct {
+	msg     *messages.Event
+	p       *pipe.Pipe
+	code    int32
+	message string
+	// release stops renewing the message's lease, which is held while it's queued
+	release func()
+}
+
+// completer logs and completes messages queued by the worker's handlers
+type completer struct {
+	queue chan completion
+	wg    sync.WaitGroup
+}
+
+// startCompleter starts the worker's completer goroutines, which run until it is closed
+func (w *Worker) startCompleter() *completer {
+	a := w.completion
+	c := &completer{queue: make(chan completion, a.QueueSize)}
+	for i := 0; i < a.Workers; i++ {
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			for {
+				batch, open := c.take(a.BatchSize)
+				w.completeAll(batch)
+				if !open {
+					return
+				}
+			}
+		}()
+	}
+	return c
+}
+
+// take returns up to n queued completions, waiting for the first. It returns false once the queue is closed
+func (c *completer) take(n int) ([]completion, bool) {
+	first, ok := <-c.queue
+	if !ok {
+		return nil, false
+	}
+	out := []completion{first}
+	for len(out) < n {
+		select {
+		case next, ok := <-c.queue:
+			if !ok {
+				return out, false
+			}
+			out = append(out, next)
+		default:
+			return out, true
+		}
+	}
+	return out, true
+}
+
+// close stops taking completions, and waits for the queued ones to be made
+func (c *completer) close() {
+	close(c.queue)
+	c.wg.Wait()
+}
+
+// completeAll makes completions concurrently
+func (w *Worker) completeAll(batch []completion) {
+	if len(batch) == 1 {
+		w.completeNow(batch[0])
+		return
+	}
+	wg := sync.WaitGroup{}
+	for _, c := range batch {
+		wg.Add(1)
+		go func(c completion) {
+			defer wg.Done()
+			w.completeNow(c)
+		}(c)
+	}
+	wg.Wait()
+}
+
+// completeNow logs and completes a message, holding its lease until it's done, so a slow completion
+//  isn't redelivered meanwhile
+func (w *Worker) completeNow(c completion) {
+	defer c.release()
+	a := w.completion
+	policy := a.Retry
+	if policy.Backoff == nil && policy.MaxAttempts == 0 && policy.MaxElapsed == 0 {
+		policy = w.apiRetry
+	}
+	if c.code != LogCodeCompleted || !a.SuppressSuccessLog {
+		w.callAPI(policy, func() error {
+			return c.p.Log(c.msg.GetStringId(), c.code, c.message)
+		})
+	}
+	w.completeStep(c.msg, c.p, policy)
+}
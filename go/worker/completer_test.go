@@ -0,0 +1,154 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nochte/pipelinr-clients/go/lib/retry"
+	"github.com/nochte/pipelinr-clients/go/pipe"
+	"github.com/nochte/pipelinr-protocol/protobuf/messages"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// gatedDriver completes messages only as its gate lets them through, or fails them if it is nil
+type gatedDriver struct {
+	*countingDriver
+	gate chan struct{}
+}
+
+func (d *gatedDriver) Complete(id, step string) error {
+	if d.gate == nil {
+		return errors.New("unavailable")
+	}
+	<-d.gate
+	return d.countingDriver.Complete(id, step)
+}
+
+func TestWorkerAsyncCompletion(t *testing.T) {
+	Convey("Worker completing asynchronously", t, func() {
+		driver := &gatedDriver{countingDriver: newCountingDriver(), gate: make(chan struct{})}
+		w := newMemoryWorker(driver, 10)
+		w.OnMessage(func(msg *messages.Event, p *pipe.Pipe) error {
+			return nil
+		})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		Reset(cancel)
+
+		ids := make([]string, 0)
+		for i := 0; i < 5; i++ {
+			id, _ := driver.Send(`{}`, []string{w.Step()})
+			ids = append(ids, id)
+		}
+
+		Convey("keeps handling while completions are slow", func() {
+			w.SetAsyncCompletion(AsyncCompletion{Workers: 1, SuppressSuccessLog: true})
+			go w.Run(ctx)
+
+			So(eventually(func() bool { return w.Stats().Handled == 5 }), ShouldBeTrue)
+			So(driver.Completes(ids[0]), ShouldEqual, 0)
+			close(driver.gate)
+			So(eventually(func() bool { return w.CompletionBacklog() == 0 && driver.Completes(ids[4]) == 1 }), ShouldBeTrue)
+			So(driver.Message(ids[0]).GetRouteLog(), ShouldBeEmpty)
+		})
+
+		Convey("holds up handling once its queue is full", func() {
+			w.SetAsyncCompletion(AsyncCompletion{Workers: 1, QueueSize: 1})
+			go w.Run(ctx)
+
+			// one being completed, one queued and one waiting for room
+			So(eventually(func() bool { return w.Stats().Handled == 3 }), ShouldBeTrue)
+			time.Sleep(time.Millisecond * 50)
+			So(w.Stats().Handled, ShouldEqual, 3)
+			So(w.CompletionBacklog(), ShouldEqual, 1)
+
+			close(driver.gate)
+			So(eventually(func() bool { return w.Stats().Handled == 5 && driver.Completes(ids[4]) == 1 }), ShouldBeTrue)
+			So(driver.Message(ids[0]).GetRouteLog()[0].GetMessage(), ShouldStartWith, "completed step")
+		})
+
+		Convey("finishes its queue when stopped", func() {
+			w.SetAsyncCompletion(AsyncCompletion{Workers: 2})
+			ran := make(chan error)
+			go func() {
+				ran <- w.Run(ctx)
+			}()
+
+			So(eventually(func() bool { return w.Stats().Handled == 5 }), ShouldBeTrue)
+			cancel()
+			go func() {
+				for range ids {
+					driver.gate <- struct{}{}
+				}
+			}()
+			So(<-ran, ShouldBeNil)
+			for _, id := range ids {
+				So(driver.Completes(id), ShouldEqual, 1)
+			}
+		})
+
+		Convey("holds the lease of a message until it's completed", func() {
+			// redelivered after 50ms without an ack
+			redelivery := int64(5)
+			w.SetReceiveOptions(nil, nil, &redelivery, nil, nil, nil, nil, nil)
+			w.SetLeaseExtension(time.Millisecond*20, time.Second)
+			w.SetAsyncCompletion(AsyncCompletion{Workers: 1, SuppressSuccessLog: true})
+			go w.Run(ctx)
+
+			So(eventually(func() bool { return w.Stats().Handled == 5 }), ShouldBeTrue)
+			time.Sleep(time.Millisecond * 150)
+			close(driver.gate)
+			So(eventually(func() bool { return w.CompletionBacklog() == 0 && driver.Completes(ids[4]) == 1 }), ShouldBeTrue)
+			for _, id := range ids {
+				So(driver.Deliveries(id, w.Step()), ShouldEqual, 1)
+				So(driver.Completes(id), ShouldEqual, 1)
+			}
+			So(w.Stats().Handled, ShouldEqual, 5)
+		})
+
+		Convey("keeps each run's queue to itself", func() {
+			close(driver.gate)
+			w.SetAsyncCompletion(AsyncCompletion{})
+			w.SetDrain(time.Millisecond*50, DrainAbandon)
+			release := make(chan struct{})
+			w.OnMessage(func(msg *messages.Event, p *pipe.Pipe) error {
+				if msg.GetStringId() == ids[0] {
+					<-release
+				}
+				return nil
+			})
+
+			first, stop := context.WithCancel(ctx)
+			ran := make(chan error)
+			go func() {
+				ran <- w.Run(first)
+			}()
+			So(eventually(func() bool { return w.Stats().Handled == 1 }), ShouldBeTrue)
+			stop()
+			So(errors.Is(<-ran, context.DeadlineExceeded), ShouldBeTrue)
+
+			go w.Run(ctx)
+			// the first run finishes, closing its own queue
+			close(release)
+			So(eventually(func() bool { return driver.Completes(ids[0]) == 1 }), ShouldBeTrue)
+			So(eventually(func() bool { return driver.Completes(ids[4]) == 1 }), ShouldBeTrue)
+			id, _ := driver.Send(`{}`, []string{w.Step()})
+			So(eventually(func() bool { return driver.Completes(id) == 1 }), ShouldBeTrue)
+		})
+
+		Convey("counts the messages it couldn't complete", func() {
+			driver.gate = nil
+			w.SetAsyncCompletion(AsyncCompletion{Retry: retry.Policy{Backoff: retry.Constant(time.Millisecond), MaxAttempts: 2}})
+			errs := make(chan error, 10)
+			w.OnError(func(msg *messages.Event, er error, p *pipe.Pipe) {
+				errs <- er
+			})
+			go w.Run(ctx)
+
+			So(eventually(func() bool { return w.Stats().Uncompleted == 5 }), ShouldBeTrue)
+			So((<-errs).Error(), ShouldEqual, "complete: unavailable")
+		})
+	})
+}
@@ -0,0 +1,82 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/nochte/pipelinr-clients/go/pipe"
+	"github.com/nochte/pipelinr-protocol/protobuf/messages"
+)
+
+// ErrTimeout is wrapped by the error of a message whose handlers ran past their deadline
+var ErrTimeout = errors.New("handler timed out")
+
+// redeliveryShare is the share of the RedeliveryTimeout handlers get by default, leaving the rest to
+//  log and complete the message before pipelinr redelivers it
+const redeliveryShare = 0.9
+
+type messageKey struct{}
+
+type messageInfo struct {
+	id          string
+	step        string
+	deliveredAt time.Time
+	// worker is the worker handling the message, for Recover to count its panics
+	worker *Worker
+}
+
+// MessageID returns the id of the message being handled, empty outside of a handler or in a BatchHandler
+func MessageID(ctx context.Context) string {
+	info, _ := ctx.Value(messageKey{}).(messageInfo)
+	return info.id
+}
+
+// Step returns the step the message is being handled for, empty outside of a handler
+func Step(ctx context.Context) string {
+	info, _ := ctx.Value(messageKey{}).(messageInfo)
+	return info.step
+}
+
+// DeliveredAt returns when the worker took the message from its pipe, zero outside of a handler
+func DeliveredAt(ctx context.Context) time.Time {
+	info, _ := ctx.Value(messageKey{}).(messageInfo)
+	return info.deliveredAt
+}
+
+// messageContext returns the context handlers get for msg, carrying its id, step and delivery time
+//  Its deadline is the worker's handler timeout, or else the max lease when the worker extends leases,
+//  or else a share of the pipe's RedeliveryTimeout
+func (w *Worker) messageContext(ctx context.Context, msg *messages.Event, p *pipe.Pipe, deliveredAt time.Time) (context.Context, context.CancelFunc) {
+	ctx = context.WithValue(ctx, messageKey{}, messageInfo{
+		id:          msg.GetStringId(),
+		step:        p.Step(),
+		deliveredAt: deliveredAt,
+		worker:      w,
+	})
+	return w.withDeadline(ctx, p, deliveredAt)
+}
+
+// batchContext returns the context a BatchHandler gets for messages from p, which carries their step
+//  and delivery time but no id, and has the deadline a single message would
+func (w *Worker) batchContext(ctx context.Context, p *pipe.Pipe, deliveredAt time.Time) (context.Context, context.CancelFunc) {
+	ctx = context.WithValue(ctx, messageKey{}, messageInfo{
+		step:        p.Step(),
+		deliveredAt: deliveredAt,
+	})
+	return w.withDeadline(ctx, p, deliveredAt)
+}
+
+// withDeadline returns ctx with the deadline for handling messages from p that were delivered at deliveredAt
+func (w *Worker) withDeadline(ctx context.Context, p *pipe.Pipe, deliveredAt time.Time) (context.Context, context.CancelFunc) {
+	timeout := w.handlerTimeout
+	if timeout <= 0 && w.renewalInterval(p) > 0 {
+		timeout = w.maxLease
+	} else if timeout <= 0 {
+		timeout = time.Duration(float64(p.ReceiveOptions().GetRedeliveryTimeout()) * redeliveryShare * float64(time.Second))
+	}
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadline(ctx, deliveredAt.Add(timeout))
+}
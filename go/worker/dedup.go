@@ -0,0 +1,78 @@
+package worker
+
+import (
+	"container/list"
+	"sync"
+)
+
+// DedupStore records the (message id, step) pairs a worker has completed, so it can tell a
+//  redelivered message from a new one
+type DedupStore interface {
+	// Seen returns whether id was recorded as completed at step
+	Seen(id, step string) (bool, error)
+	// Mark records id as completed at step
+	Mark(id, step string) error
+}
+
+// DefaultDedupSize is how many pairs a MemoryDedup created with a size of 0 remembers
+const DefaultDedupSize = 10000
+
+type dedupKey struct {
+	id   string
+	step string
+}
+
+// MemoryDedup is an in-process DedupStore that remembers the most recently used pairs, forgetting the
+//  least recently used ones once it's full
+type MemoryDedup struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[dedupKey]*list.Element
+}
+
+// NewMemoryDedup returns a MemoryDedup that remembers up to size pairs, DefaultDedupSize if size is 0
+func NewMemoryDedup(size int) *MemoryDedup {
+	if size <= 0 {
+		size = DefaultDedupSize
+	}
+	return &MemoryDedup{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[dedupKey]*list.Element),
+	}
+}
+
+func (d *MemoryDedup) Seen(id, step string) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	el, ok := d.entries[dedupKey{id, step}]
+	if ok {
+		d.order.MoveToFront(el)
+	}
+	return ok, nil
+}
+
+func (d *MemoryDedup) Mark(id, step string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	key := dedupKey{id, step}
+	if el, ok := d.entries[key]; ok {
+		d.order.MoveToFront(el)
+		return nil
+	}
+	d.entries[key] = d.order.PushFront(key)
+	for d.order.Len() > d.size {
+		oldest := d.order.Back()
+		d.order.Remove(oldest)
+		delete(d.entries, oldest.Value.(dedupKey))
+	}
+	return nil
+}
+
+// Len returns how many pairs are remembered
+func (d *MemoryDedup) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.order.Len()
+}
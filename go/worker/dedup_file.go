@@ -0,0 +1,70 @@
+package worker
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// FileDedup is a DedupStore that appends each pair to a file, so it survives restarts
+//  Every pair in the file is kept in memory, so it suits modest volumes; rotate the file to trim it
+type FileDedup struct {
+	mu      sync.Mutex
+	file    *os.File
+	entries map[dedupKey]struct{}
+}
+
+// OpenFileDedup opens the FileDedup at path, creating the file if needed and loading the pairs in it
+func OpenFileDedup(path string) (*FileDedup, error) {
+	file, er := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if er != nil {
+		return nil, er
+	}
+
+	entries := make(map[dedupKey]struct{})
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), "\t", 2)
+		if len(parts) != 2 {
+			// a partial line from a crash mid-write
+			continue
+		}
+		entries[dedupKey{parts[0], parts[1]}] = struct{}{}
+	}
+	if er := scanner.Err(); er != nil {
+		file.Close()
+		return nil, fmt.Errorf("reading %v: %w", path, er)
+	}
+
+	return &FileDedup{file: file, entries: entries}, nil
+}
+
+func (d *FileDedup) Seen(id, step string) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, ok := d.entries[dedupKey{id, step}]
+	return ok, nil
+}
+
+func (d *FileDedup) Mark(id, step string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	key := dedupKey{id, step}
+	if _, ok := d.entries[key]; ok {
+		return nil
+	}
+	if _, er := fmt.Fprintf(d.file, "%v\t%v\n", id, step); er != nil {
+		return er
+	}
+	d.entries[key] = struct{}{}
+	return nil
+}
+
+// Close closes the underlying file
+func (d *FileDedup) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.file.Close()
+}
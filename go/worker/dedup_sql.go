@@ -0,0 +1,60 @@
+package worker
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// SQLDedup is a DedupStore backed by a database/sql table, so workers on several hosts can share it
+type SQLDedup struct {
+	db          *sql.DB
+	table       string
+	placeholder func(n int) string
+}
+
+// NewSQLDedup returns a SQLDedup using table in db. placeholder returns the nth (from 1) bind
+//  parameter in the database's dialect; nil uses "?", see DollarPlaceholder for postgres
+func NewSQLDedup(db *sql.DB, table string, placeholder func(n int) string) *SQLDedup {
+	if placeholder == nil {
+		placeholder = func(int) string { return "?" }
+	}
+	return &SQLDedup{db: db, table: table, placeholder: placeholder}
+}
+
+// DollarPlaceholder returns postgres style bind parameters: $1, $2...
+func DollarPlaceholder(n int) string {
+	return fmt.Sprintf("$%v", n)
+}
+
+// CreateTable creates the dedup table if it doesn't exist
+func (d *SQLDedup) CreateTable(ctx context.Context) error {
+	_, er := d.db.ExecContext(ctx, fmt.Sprintf(
+		"CREATE TABLE IF NOT EXISTS %v (message_id VARCHAR(64) NOT NULL, step VARCHAR(255) NOT NULL, PRIMARY KEY (message_id, step))",
+		d.table))
+	return er
+}
+
+func (d *SQLDedup) Seen(id, step string) (bool, error) {
+	var one int
+	er := d.db.QueryRow(fmt.Sprintf(
+		"SELECT 1 FROM %v WHERE message_id = %v AND step = %v",
+		d.table, d.placeholder(1), d.placeholder(2)), id, step).Scan(&one)
+	if er == sql.ErrNoRows {
+		return false, nil
+	}
+	return er == nil, er
+}
+
+func (d *SQLDedup) Mark(id, step string) error {
+	_, er := d.db.Exec(fmt.Sprintf(
+		"INSERT INTO %v (message_id, step) VALUES (%v, %v)",
+		d.table, d.placeholder(1), d.placeholder(2)), id, step)
+	if er != nil {
+		// a primary key conflict means it's already marked
+		if seen, _ := d.Seen(id, step); seen {
+			return nil
+		}
+	}
+	return er
+}
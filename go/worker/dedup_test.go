@@ -0,0 +1,130 @@
+package worker
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDedupStores(t *testing.T) {
+	Convey("Dedup stores", t, func() {
+		Convey("MemoryDedup forgets the least recently used pairs", func() {
+			d := NewMemoryDedup(2)
+			So(d.Mark("a", "step"), ShouldBeNil)
+			So(d.Mark("b", "step"), ShouldBeNil)
+			seen, _ := d.Seen("a", "step")
+			So(seen, ShouldBeTrue)
+			So(d.Mark("c", "step"), ShouldBeNil)
+
+			seen, _ = d.Seen("b", "step")
+			So(seen, ShouldBeFalse)
+			seen, _ = d.Seen("a", "step")
+			So(seen, ShouldBeTrue)
+			seen, _ = d.Seen("c", "other-step")
+			So(seen, ShouldBeFalse)
+			So(d.Len(), ShouldEqual, 2)
+		})
+
+		Convey("FileDedup survives reopening", func() {
+			path := filepath.Join(t.TempDir(), "dedup")
+			d, er := OpenFileDedup(path)
+			So(er, ShouldBeNil)
+			So(d.Mark("a", "step"), ShouldBeNil)
+			So(d.Mark("a", "step"), ShouldBeNil)
+			So(d.Close(), ShouldBeNil)
+
+			d, er = OpenFileDedup(path)
+			So(er, ShouldBeNil)
+			Reset(func() { d.Close() })
+			seen, _ := d.Seen("a", "step")
+			So(seen, ShouldBeTrue)
+			seen, _ = d.Seen("b", "step")
+			So(seen, ShouldBeFalse)
+		})
+
+		Convey("SQLDedup queries its table", func() {
+			db := sql.OpenDB(&fakeDB{rows: make(map[string]bool)})
+			Reset(func() { db.Close() })
+			d := NewSQLDedup(db, "dedup", DollarPlaceholder)
+			So(d.CreateTable(context.Background()), ShouldBeNil)
+
+			seen, er := d.Seen("a", "step")
+			So(er, ShouldBeNil)
+			So(seen, ShouldBeFalse)
+			So(d.Mark("a", "step"), ShouldBeNil)
+			So(d.Mark("a", "step"), ShouldBeNil)
+			seen, er = d.Seen("a", "step")
+			So(er, ShouldBeNil)
+			So(seen, ShouldBeTrue)
+		})
+	})
+}
+
+// fakeDB is a database/sql driver that understands just SQLDedup's queries
+type fakeDB struct {
+	mu   sync.Mutex
+	rows map[string]bool
+}
+
+func (f *fakeDB) Connect(context.Context) (driver.Conn, error) { return f, nil }
+func (f *fakeDB) Driver() driver.Driver                        { return nil }
+func (f *fakeDB) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{db: f, query: query}, nil
+}
+func (f *fakeDB) Close() error              { return nil }
+func (f *fakeDB) Begin() (driver.Tx, error) { return nil, errors.New("not supported") }
+
+type fakeStmt struct {
+	db    *fakeDB
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	switch {
+	case strings.HasPrefix(s.query, "CREATE TABLE IF NOT EXISTS dedup "):
+	case s.query == "INSERT INTO dedup (message_id, step) VALUES ($1, $2)":
+		key := args[0].(string) + "/" + args[1].(string)
+		if s.db.rows[key] {
+			return nil, errors.New("duplicate key")
+		}
+		s.db.rows[key] = true
+	default:
+		return nil, errors.New("unexpected query " + s.query)
+	}
+	return driver.RowsAffected(1), nil
+}
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	if s.query != "SELECT 1 FROM dedup WHERE message_id = $1 AND step = $2" {
+		return nil, errors.New("unexpected query " + s.query)
+	}
+	return &fakeRows{found: s.db.rows[args[0].(string)+"/"+args[1].(string)]}, nil
+}
+
+type fakeRows struct {
+	found bool
+}
+
+func (r *fakeRows) Columns() []string { return []string{"1"} }
+func (r *fakeRows) Close() error      { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if !r.found {
+		return io.EOF
+	}
+	r.found = false
+	dest[0] = int64(1)
+	return nil
+}
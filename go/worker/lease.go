@@ -0,0 +1,87 @@
+package worker
+
+import (
+	"context"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/nochte/pipelinr-clients/go/pipe"
+	"github.com/nochte/pipelinr-protocol/protobuf/messages"
+)
+
+// leaseShare is the share of the RedeliveryTimeout between lease renewals by default, leaving time
+//  for a renewal or two to fail before pipelinr redelivers the message
+const leaseShare = 1.0 / 3
+
+// SetLeaseExtension has the worker renew the lease on each message it holds by acking it every
+//  interval, from when it takes the message from its pipe until the handlers are done, so a
+//  long-running handler's message, or the next one in line for a handler, isn't redelivered to another
+//  worker. Messages the pipe has fetched beyond those aren't held, so the receive options' Count
+//  should be no more than the concurrency, or the RedeliveryTimeout should cover their wait. It stops
+//  renewing once the message has been held for max in total; with no handler timeout set, max also
+//  becomes the handlers' deadline. A max of 0 renews until the handlers are done
+// An interval of 0 renews at a third of the pipe's RedeliveryTimeout. It should be called before Run
+func (w *Worker) SetLeaseExtension(interval, max time.Duration) {
+	w.leaseExtension = true
+	w.leaseInterval = interval
+	w.maxLease = max
+}
+
+// renewalInterval returns how often the worker renews a held message's lease, 0 if it doesn't
+func (w *Worker) renewalInterval(p *pipe.Pipe) time.Duration {
+	if !w.leaseExtension {
+		return 0
+	}
+	if w.leaseInterval > 0 {
+		return w.leaseInterval
+	}
+	return time.Duration(float64(p.ReceiveOptions().GetRedeliveryTimeout()) * leaseShare * float64(time.Second))
+}
+
+// holdLease renews msg's lease in the background until the returned func is called, or until it has
+//  been held for the max lease since deliveredAt. Renewals are an interval apart from deliveredAt, so
+//  time spent waiting for a handler counts. The returned func waits for any renewal in flight, so the
+//  message can be completed right after it returns
+func (w *Worker) holdLease(msg *messages.Event, p *pipe.Pipe, deliveredAt time.Time) func() {
+	interval := w.renewalInterval(p)
+	if interval <= 0 {
+		return func() {}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if w.maxLease > 0 {
+		ctx, cancel = context.WithDeadline(context.Background(), deliveredAt.Add(w.maxLease))
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		timer := time.NewTimer(time.Until(deliveredAt.Add(interval)))
+		defer timer.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				if ctx.Err() == context.DeadlineExceeded {
+					atomic.AddUint64(&w.stats.LeasesExpired, 1)
+				}
+				return
+			case <-timer.C:
+				timer.Reset(interval)
+			}
+			if er := p.Ack(msg.GetStringId()); er != nil {
+				// the next tick tries again
+				if os.Getenv("PIPELINR_DEBUG") != "" {
+					log.Printf("%v error renewing lease on %v: %v\n", p.Step(), msg.GetStringId(), er)
+				}
+				continue
+			}
+			atomic.AddUint64(&w.stats.LeaseRenewals, 1)
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
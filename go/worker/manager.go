@@ -0,0 +1,286 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"runtime/debug"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/nochte/pipelinr-clients/go/pipe"
+	"github.com/nochte/pipelinr-clients/go/pipe/drivers"
+)
+
+// WorkerState is where a managed worker is in its lifecycle
+type WorkerState int
+
+const (
+	// WorkerIdle workers haven't been started yet
+	WorkerIdle WorkerState = iota
+	// WorkerRunning workers are handling messages
+	WorkerRunning
+	// WorkerRestarting workers have crashed, and are waiting out their backoff before running again
+	WorkerRestarting
+	// WorkerStopped workers have shut down, and won't be restarted
+	WorkerStopped
+)
+
+func (s WorkerState) String() string {
+	switch s {
+	case WorkerIdle:
+		return "idle"
+	case WorkerRunning:
+		return "running"
+	case WorkerRestarting:
+		return "restarting"
+	case WorkerStopped:
+		return "stopped"
+	}
+	return "unknown"
+}
+
+// WorkerStatus is a snapshot of a managed worker
+type WorkerStatus struct {
+	Step  string
+	State WorkerState
+	// Restarts is how many times the worker has been restarted after crashing
+	Restarts int
+	// LastError is the error the worker last crashed or stopped with
+	LastError error
+	Stats     Stats
+}
+
+// ManagerStatus is a snapshot of a Manager's workers, with their states counted and stats summed
+type ManagerStatus struct {
+	Workers    []WorkerStatus
+	Running    int
+	Restarting int
+	Stopped    int
+	Stats      Stats
+}
+
+type managed struct {
+	worker   *Worker
+	state    WorkerState
+	restarts int
+	err      error
+}
+
+// Manager runs many workers in one process, typically one per step over a shared driver
+//  It shuts them all down together on SIGINT or SIGTERM, and restarts any that crash
+type Manager struct {
+	driver     drivers.Driver
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	signals    []os.Signal
+
+	mu      sync.Mutex
+	workers []*managed
+	running bool
+	cancel  context.CancelFunc
+}
+
+// NewManager returns a Manager whose Worker method creates workers over driver, which may be nil if
+//  workers are only added with Add
+func NewManager(driver drivers.Driver) *Manager {
+	return &Manager{
+		driver:     driver,
+		minBackoff: time.Second,
+		maxBackoff: time.Minute,
+		signals:    []os.Signal{syscall.SIGINT, syscall.SIGTERM},
+		workers:    make([]*managed, 0),
+	}
+}
+
+// Worker creates a worker for step over the manager's driver, and adds it to the manager
+func (m *Manager) Worker(step string) *Worker {
+	w := New(pipe.New(m.driver, step))
+	m.Add(w)
+	return w
+}
+
+// Add adds workers to the manager; it should be called before Run
+func (m *Manager) Add(workers ...*Worker) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, w := range workers {
+		m.workers = append(m.workers, &managed{worker: w})
+	}
+}
+
+// SetRestartBackoff sets how long a crashed worker waits before it is restarted: min, doubling with
+//  each crash up to max. A worker that ran for longer than max before crashing starts over at min
+//  Defaults to 1 second and 1 minute
+func (m *Manager) SetRestartBackoff(min, max time.Duration) {
+	m.minBackoff = min
+	m.maxBackoff = max
+}
+
+// SetSignals sets the signals that shut the manager down, defaulting to SIGINT and SIGTERM
+//  With none, only the context given to Run or Stop shut it down
+func (m *Manager) SetSignals(signals ...os.Signal) {
+	m.signals = signals
+}
+
+// Stop shuts a running manager down, the same as cancelling the context given to Run
+func (m *Manager) Stop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.cancel != nil {
+		m.cancel()
+	}
+}
+
+// Run runs every worker until ctx is done, the manager is stopped or it gets one of its signals, then
+//  shuts them down together, each draining as its SetDrain allows
+// A worker that crashes, its Run returning an error, is restarted after the restart backoff; one that
+//  returns nil on its own is left stopped. Workers recover panics in their handlers and middleware,
+//  but a panic in any other callback, ex: OnError, a DedupStore, a Scheduler or an ordering key func,
+//  is on one of the worker's own goroutines, and crashes the process rather than the worker
+// Run returns once every worker has stopped: nil if they all shut down cleanly, otherwise an error
+//  wrapping the first failure
+func (m *Manager) Run(ctx context.Context) error {
+	m.mu.Lock()
+	if m.running {
+		m.mu.Unlock()
+		return errors.New("already running")
+	}
+	m.running = true
+	ctx, m.cancel = context.WithCancel(ctx)
+	if len(m.signals) > 0 {
+		var stopSignals context.CancelFunc
+		ctx, stopSignals = signal.NotifyContext(ctx, m.signals...)
+		defer stopSignals()
+	}
+	workers := append([]*managed{}, m.workers...)
+	m.mu.Unlock()
+
+	defer func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.cancel()
+		m.running = false
+	}()
+
+	errs := make(chan error, len(workers))
+	for _, mw := range workers {
+		go func(mw *managed) {
+			errs <- m.supervise(ctx, mw)
+		}(mw)
+	}
+
+	var first error
+	failed := 0
+	for range workers {
+		if er := <-errs; er != nil {
+			failed++
+			if first == nil {
+				first = er
+			}
+		}
+	}
+	if failed > 1 {
+		return fmt.Errorf("%w (and %v more workers)", first, failed-1)
+	}
+	return first
+}
+
+// supervise runs a worker until ctx is done, restarting it when it crashes
+func (m *Manager) supervise(ctx context.Context, mw *managed) error {
+	backoff := m.minBackoff
+	for {
+		m.setState(mw, WorkerRunning, nil, false)
+		startTime := time.Now()
+		er := m.run(ctx, mw.worker)
+
+		if ctx.Err() != nil || er == nil {
+			m.setState(mw, WorkerStopped, er, false)
+			if er != nil {
+				return fmt.Errorf("worker %v: %w", mw.worker.Step(), er)
+			}
+			return nil
+		}
+
+		if time.Since(startTime) > m.maxBackoff {
+			backoff = m.minBackoff
+		}
+		m.setState(mw, WorkerRestarting, er, true)
+		if os.Getenv("PIPELINR_DEBUG") != "" {
+			log.Printf("%v worker crashed, restarting in %v: %v\n", mw.worker.Step(), backoff, er)
+		}
+		if !sleep(ctx, backoff) {
+			m.setState(mw, WorkerStopped, er, false)
+			return nil
+		}
+		if backoff *= 2; backoff > m.maxBackoff {
+			backoff = m.maxBackoff
+		}
+	}
+}
+
+// run runs a worker, recovering a panic in the goroutine calling Run into a *PanicError
+func (m *Manager) run(ctx context.Context, w *Worker) (er error) {
+	defer func() {
+		if r := recover(); r != nil {
+			er = &PanicError{Value: r, Stack: debug.Stack()}
+		}
+	}()
+	return w.Run(ctx)
+}
+
+func (m *Manager) setState(mw *managed, state WorkerState, er error, restart bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mw.state = state
+	if er != nil {
+		mw.err = er
+	}
+	if restart {
+		mw.restarts++
+	}
+}
+
+// Status returns a snapshot of the manager's workers
+func (m *Manager) Status() ManagerStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	out := ManagerStatus{Workers: make([]WorkerStatus, 0, len(m.workers))}
+	for _, mw := range m.workers {
+		status := WorkerStatus{
+			Step:      mw.worker.Step(),
+			State:     mw.state,
+			Restarts:  mw.restarts,
+			LastError: mw.err,
+			Stats:     mw.worker.Stats(),
+		}
+		out.Workers = append(out.Workers, status)
+		switch status.State {
+		case WorkerRunning:
+			out.Running++
+		case WorkerRestarting:
+			out.Restarting++
+		case WorkerStopped:
+			out.Stopped++
+		}
+		out.Stats = out.Stats.add(status.Stats)
+	}
+	return out
+}
+
+// sleep waits for d, returning false if ctx is done first
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,104 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nochte/pipelinr-clients/go/lib"
+	"github.com/nochte/pipelinr-clients/go/pipe"
+	"github.com/nochte/pipelinr-clients/go/pipe/drivers"
+	"github.com/nochte/pipelinr-protocol/protobuf/messages"
+	"github.com/nochte/pipelinr-protocol/protobuf/pipes"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// errDropped is what a crashingDriver's first subscription ends with
+var errDropped = errors.New("connection dropped")
+
+// crashingDriver ends its first subscription straight away, like a dropped connection
+type crashingDriver struct {
+	*drivers.MemoryDriver
+	subscriptions int64
+}
+
+func (d *crashingDriver) Subscribe(ctx context.Context, opts *pipes.ReceiveOptions) (<-chan *messages.Event, <-chan error) {
+	if atomic.AddInt64(&d.subscriptions, 1) == 1 {
+		events, errs := make(chan *messages.Event), make(chan error, 1)
+		errs <- errDropped
+		close(events)
+		close(errs)
+		return events, errs
+	}
+	return drivers.NewPoller(d.MemoryDriver).Subscribe(ctx, opts)
+}
+
+func TestManager(t *testing.T) {
+	Convey("Manager", t, func() {
+		driver := drivers.NewMemoryDriver()
+		driver.SetTimeUnit(time.Millisecond * 10)
+		m := NewManager(driver)
+		m.SetRestartBackoff(time.Millisecond*10, time.Millisecond*50)
+		first, second := lib.GenerateRandomString(8), lib.GenerateRandomString(8)
+		for _, step := range []string{first, second} {
+			m.Worker(step).OnMessage(func(msg *messages.Event, p *pipe.Pipe) error {
+				return nil
+			})
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		Reset(cancel)
+		stopped := make(chan error, 1)
+
+		Convey("runs every worker until it's stopped", func() {
+			So(m.Status().Workers[0].State, ShouldEqual, WorkerIdle)
+			go func() { stopped <- m.Run(ctx) }()
+
+			id, _ := driver.Send(`{}`, []string{first, second})
+			So(eventually(func() bool { return len(driver.Message(id).GetCompletedSteps()) == 2 }), ShouldBeTrue)
+			status := m.Status()
+			So(status.Running, ShouldEqual, 2)
+			So(status.Stats.Completed, ShouldEqual, 2)
+			So(status.Workers[1].Stats.Completed, ShouldEqual, 1)
+			So(m.Run(ctx), ShouldNotBeNil)
+
+			m.Stop()
+			So(<-stopped, ShouldBeNil)
+			So(m.Status().Stopped, ShouldEqual, 2)
+		})
+
+		Convey("shuts down on SIGINT", func() {
+			go func() { stopped <- m.Run(ctx) }()
+			So(eventually(func() bool { return m.Status().Running == 2 }), ShouldBeTrue)
+
+			self, _ := os.FindProcess(os.Getpid())
+			So(self.Signal(os.Interrupt), ShouldBeNil)
+			So(<-stopped, ShouldBeNil)
+			So(m.Status().Stopped, ShouldEqual, 2)
+		})
+
+		Convey("restarts crashed workers", func() {
+			crashing := &crashingDriver{MemoryDriver: driver}
+			w := New(pipe.New(crashing, lib.GenerateRandomString(8)))
+			w.OnMessage(func(msg *messages.Event, p *pipe.Pipe) error {
+				return nil
+			})
+			m.Add(w)
+			go func() { stopped <- m.Run(ctx) }()
+
+			id, _ := driver.Send(`{}`, []string{w.Step()})
+			So(eventually(func() bool { return len(driver.Message(id).GetCompletedSteps()) == 1 }), ShouldBeTrue)
+			status := m.Status().Workers[2]
+			So(status.State, ShouldEqual, WorkerRunning)
+			So(status.Restarts, ShouldEqual, 1)
+			So(errors.Is(status.LastError, errDropped), ShouldBeTrue)
+			So(status.LastError.Error(), ShouldEqual, "worker pipe stopped: subscription ended: connection dropped")
+
+			cancel()
+			So(<-stopped, ShouldBeNil)
+		})
+	})
+}
@@ -0,0 +1,126 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/nochte/pipelinr-clients/go/pipe"
+	"github.com/nochte/pipelinr-protocol/protobuf/messages"
+	"github.com/tidwall/gjson"
+)
+
+// Matcher decides whether a handler registered with HandleMatch should handle a message
+type Matcher func(*messages.Event) bool
+
+// MatchType matches events of type t
+func MatchType(t messages.EventType) Matcher {
+	return func(msg *messages.Event) bool {
+		return msg.GetType() == t
+	}
+}
+
+// MatchField matches messages whose payload has value at the gjson path, compared as strings
+//  ex: MatchField("order.status", "paid")
+func MatchField(path string, value interface{}) Matcher {
+	want := fmt.Sprintf("%v", value)
+	return func(msg *messages.Event) bool {
+		got := gjson.Get(payload(msg), path)
+		return got.Exists() && got.String() == want
+	}
+}
+
+// MatchExists matches messages whose payload has anything at the gjson path
+func MatchExists(path string) Matcher {
+	return func(msg *messages.Event) bool {
+		return gjson.Get(payload(msg), path).Exists()
+	}
+}
+
+// MatchFieldFunc matches messages for which fn returns true, given what is at the gjson path of
+//  their payload
+func MatchFieldFunc(path string, fn func(gjson.Result) bool) Matcher {
+	return func(msg *messages.Event) bool {
+		return fn(gjson.Get(payload(msg), path))
+	}
+}
+
+// MatchAll matches messages that every one of matchers matches
+func MatchAll(matchers ...Matcher) Matcher {
+	return func(msg *messages.Event) bool {
+		for _, m := range matchers {
+			if !m(msg) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// payload returns the message's decorated payload, or its payload if it hasn't been decorated
+func payload(msg *messages.Event) string {
+	if decorated := msg.GetMessage().GetDecoratedPayload(); decorated != "" {
+		return decorated
+	}
+	return msg.GetMessage().GetPayload()
+}
+
+// router hands each message to the first of its routes that matches it
+type router struct {
+	routes    []route
+	fallback  Handler
+	unmatched Action
+}
+
+type route struct {
+	match   Matcher
+	handler Handler
+}
+
+func (r *router) handle(ctx context.Context, msg *messages.Event, p *pipe.Pipe) Outcome {
+	for _, rt := range r.routes {
+		if rt.match(msg) {
+			return rt.handler(ctx, msg, p)
+		}
+	}
+	if r.fallback != nil {
+		return r.fallback(ctx, msg, p)
+	}
+	if r.unmatched == ActionComplete {
+		return Completed()
+	}
+	return Outcome{Action: r.unmatched, Err: fmt.Errorf("no handler for %v event", msg.GetType())}
+}
+
+// router returns the worker's router, adding it to the onMessage chain the first time
+func (w *Worker) router() *router {
+	if w.routes == nil {
+		w.routes = &router{unmatched: ActionComplete}
+		w.onMessage = append(w.onMessage, w.routes.handle)
+	}
+	return w.routes
+}
+
+// Handle has h handle events of type t, instead of every handler switching on the type
+//  The handlers given to Handle, HandleMatch and HandleDefault take one place in the onMessage chain,
+//  where the first of them is registered, and only the first one matching a message runs
+func (w *Worker) Handle(t messages.EventType, h Handler) {
+	w.HandleMatch(MatchType(t), h)
+}
+
+// HandleMatch has h handle the messages match matches, see Handle
+func (w *Worker) HandleMatch(match Matcher, h Handler) {
+	r := w.router()
+	r.routes = append(r.routes, route{match: match, handler: h})
+}
+
+// HandleDefault has h handle the messages no handler given to Handle or HandleMatch matches
+func (w *Worker) HandleDefault(h Handler) {
+	w.router().fallback = h
+}
+
+// SetUnmatchedAction sets what the worker does with a message no Handle or HandleMatch handler
+//  matches, when there is no HandleDefault handler: ActionComplete (the default), ActionFail,
+//  ActionDeadLetter or ActionLeave
+func (w *Worker) SetUnmatchedAction(action Action) {
+	w.router().unmatched = action
+}
@@ -0,0 +1,117 @@
+package worker
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/nochte/pipelinr-clients/go/pipe"
+	"github.com/nochte/pipelinr-protocol/protobuf/messages"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/tidwall/gjson"
+)
+
+func event(t messages.EventType, payload, decorated string) *messages.Event {
+	return &messages.Event{Type: t, Message: &messages.MessageEnvelop{Payload: payload, DecoratedPayload: decorated}}
+}
+
+func TestMatchers(t *testing.T) {
+	Convey("Matchers", t, func() {
+		paid := event(messages.EventType_Created, `{"order":{"status":"paid","total":12}}`, "")
+
+		Convey("match event types", func() {
+			So(MatchType(messages.EventType_Created)(paid), ShouldBeTrue)
+			So(MatchType(messages.EventType_PipelineElementCompleted)(paid), ShouldBeFalse)
+		})
+
+		Convey("match payload fields", func() {
+			So(MatchField("order.status", "paid")(paid), ShouldBeTrue)
+			So(MatchField("order.total", 12)(paid), ShouldBeTrue)
+			So(MatchField("order.status", "refunded")(paid), ShouldBeFalse)
+			So(MatchField("order.missing", "")(paid), ShouldBeFalse)
+			So(MatchExists("order.total")(paid), ShouldBeTrue)
+			So(MatchExists("order.missing")(paid), ShouldBeFalse)
+			So(MatchFieldFunc("order.total", func(r gjson.Result) bool { return r.Int() > 10 })(paid), ShouldBeTrue)
+		})
+
+		Convey("prefer the decorated payload", func() {
+			decorated := event(messages.EventType_Created, `{"status":"new"}`, `{"status":"paid"}`)
+			So(MatchField("status", "paid")(decorated), ShouldBeTrue)
+		})
+
+		Convey("combine", func() {
+			So(MatchAll(MatchType(messages.EventType_Created), MatchField("order.status", "paid"))(paid), ShouldBeTrue)
+			So(MatchAll(MatchType(messages.EventType_Created), MatchField("order.status", "new"))(paid), ShouldBeFalse)
+		})
+	})
+}
+
+func TestWorkerHandle(t *testing.T) {
+	Convey("Worker handlers by type and payload", t, func() {
+		w := newMemoryWorker(newCountingDriver(), 1)
+		handled := make([]string, 0)
+		named := func(name string) Handler {
+			return func(ctx context.Context, msg *messages.Event, p *pipe.Pipe) Outcome {
+				handled = append(handled, name)
+				return Completed()
+			}
+		}
+		w.OnMessage(func(msg *messages.Event, p *pipe.Pipe) error {
+			handled = append(handled, "first")
+			return nil
+		})
+		w.HandleMatch(MatchField("kind", "refund"), named("refund"))
+		w.Handle(messages.EventType_Created, named("created"))
+		chain := w.chain()
+
+		Convey("run the first handler that matches", func() {
+			So(chain(context.Background(), event(messages.EventType_Created, `{"kind":"refund"}`, ""), w.Pipe()).Action, ShouldEqual, ActionComplete)
+			So(chain(context.Background(), event(messages.EventType_Created, `{"kind":"order"}`, ""), w.Pipe()).Action, ShouldEqual, ActionComplete)
+			So(handled, ShouldResemble, []string{"first", "refund", "first", "created"})
+		})
+
+		Convey("complete unmatched messages by default", func() {
+			So(chain(context.Background(), event(messages.EventType_PipelineElementCompleted, `{}`, ""), w.Pipe()).Action, ShouldEqual, ActionComplete)
+			So(handled, ShouldResemble, []string{"first"})
+		})
+
+		Convey("take the unmatched action", func() {
+			w.SetUnmatchedAction(ActionDeadLetter)
+			outcome := chain(context.Background(), event(messages.EventType_PipelineElementCompleted, `{}`, ""), w.Pipe())
+			So(outcome.Action, ShouldEqual, ActionDeadLetter)
+			So(outcome.Err.Error(), ShouldEqual, "no handler for PipelineElementCompleted event")
+			So(outcome.source(), ShouldEqual, "handler 1")
+		})
+
+		Convey("run the fallback handler for unmatched messages", func() {
+			w.SetUnmatchedAction(ActionFail)
+			w.HandleDefault(named("fallback"))
+			So(chain(context.Background(), event(messages.EventType_PipelineElementCompleted, `{}`, ""), w.Pipe()).Action, ShouldEqual, ActionComplete)
+			So(handled, ShouldResemble, []string{"first", "fallback"})
+		})
+	})
+
+	Convey("Worker handling events by type", t, func() {
+		driver := newCountingDriver()
+		w := newMemoryWorker(driver, 2)
+		ctx, cancel := context.WithCancel(context.Background())
+		Reset(cancel)
+
+		mu := sync.Mutex{}
+		created := make([]string, 0)
+		w.Handle(messages.EventType_Created, func(ctx context.Context, msg *messages.Event, p *pipe.Pipe) Outcome {
+			mu.Lock()
+			defer mu.Unlock()
+			created = append(created, msg.GetStringId())
+			return Completed()
+		})
+		w.SetUnmatchedAction(ActionLeave)
+		go w.Run(ctx)
+
+		id, _ := driver.Send(`{}`, []string{w.Step()})
+		So(eventually(func() bool { return driver.Completes(id) == 1 }), ShouldBeTrue)
+		mu.Lock()
+		defer mu.Unlock()
+		So(created, ShouldResemble, []string{id})
+	})
+}
@@ -0,0 +1,122 @@
+package worker
+
+import (
+	"context"
+	"log"
+	"runtime/debug"
+	"time"
+
+	"github.com/nochte/pipelinr-clients/go/pipe"
+	"github.com/nochte/pipelinr-protocol/protobuf/messages"
+)
+
+// Middleware wraps a Handler, like net/http middleware
+//  Middleware registered with Use runs around the whole onMessage chain, once per message
+type Middleware func(Handler) Handler
+
+// Use adds middleware around the onMessage chain; the first one given is the outermost
+//  It should be called before Run
+func (w *Worker) Use(mw ...Middleware) {
+	w.middleware = append(w.middleware, mw...)
+}
+
+// chain returns the onMessage chain wrapped in the worker's middleware
+//  Panics are always recovered: from each handler, so the middleware sees them as failures, and
+//  around the middleware itself
+func (w *Worker) chain() Handler {
+	var h Handler = func(ctx context.Context, msg *messages.Event, p *pipe.Pipe) Outcome {
+		for ndx := range w.onMessage {
+			if outcome := w.call(w.onMessage[ndx], ctx, msg, p); outcome.Action != ActionComplete {
+				outcome.handler = ndx + 1
+				return outcome
+			}
+		}
+		return Completed()
+	}
+	for ndx := len(w.middleware) - 1; ndx >= 0; ndx-- {
+		h = w.middleware[ndx](h)
+	}
+
+	wrapped := h
+	return func(ctx context.Context, msg *messages.Event, p *pipe.Pipe) Outcome {
+		return w.call(wrapped, ctx, msg, p)
+	}
+}
+
+// call runs a handler, recovering any panic into a Fail outcome
+func (w *Worker) call(h Handler, ctx context.Context, msg *messages.Event, p *pipe.Pipe) (outcome Outcome) {
+	defer func() {
+		if r := recover(); r != nil {
+			outcome = w.recovered(r)
+		}
+	}()
+	return h(ctx, msg, p)
+}
+
+// Recover returns middleware that turns a panic in what it wraps into a Fail outcome with a *PanicError
+//  The worker already recovers panics from handlers and around all middleware; Recover is for
+//  recovering panics from middleware registered after it. They're counted in the worker's Panics
+func Recover() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, msg *messages.Event, p *pipe.Pipe) (outcome Outcome) {
+			defer func() {
+				if r := recover(); r != nil {
+					if info, _ := ctx.Value(messageKey{}).(messageInfo); info.worker != nil {
+						outcome = info.worker.recovered(r)
+						return
+					}
+					outcome = Fail(&PanicError{Value: r, Stack: debug.Stack()})
+				}
+			}()
+			return next(ctx, msg, p)
+		}
+	}
+}
+
+// Timing returns middleware that reports how long the handlers took for each message, and their outcome
+func Timing(report func(msg *messages.Event, outcome Outcome, elapsed time.Duration)) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, msg *messages.Event, p *pipe.Pipe) Outcome {
+			startTime := time.Now()
+			outcome := next(ctx, msg, p)
+			report(msg, outcome, time.Since(startTime))
+			return outcome
+		}
+	}
+}
+
+// Logging returns middleware that writes a key=value line to logger for each message handled
+//  A nil logger uses the standard logger
+func Logging(logger *log.Logger) Middleware {
+	if logger == nil {
+		logger = log.Default()
+	}
+	return func(next Handler) Handler {
+		return func(ctx context.Context, msg *messages.Event, p *pipe.Pipe) Outcome {
+			startTime := time.Now()
+			outcome := next(ctx, msg, p)
+			if outcome.Err != nil {
+				logger.Printf("step=%q id=%v action=%v elapsed=%v error=%q", p.Step(), msg.GetStringId(), outcome.Action, time.Since(startTime), outcome.Err.Error())
+			} else {
+				logger.Printf("step=%q id=%v action=%v elapsed=%v", p.Step(), msg.GetStringId(), outcome.Action, time.Since(startTime))
+			}
+			return outcome
+		}
+	}
+}
+
+// Tracer starts a trace span for a message, returning the context to hand to the handlers and a func
+//  that ends the span with the message's outcome
+type Tracer func(ctx context.Context, msg *messages.Event) (context.Context, func(Outcome))
+
+// Tracing returns middleware that traces each message with tracer, ex: to bridge to OpenTelemetry
+func Tracing(tracer Tracer) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, msg *messages.Event, p *pipe.Pipe) Outcome {
+			ctx, end := tracer(ctx, msg)
+			outcome := next(ctx, msg, p)
+			end(outcome)
+			return outcome
+		}
+	}
+}
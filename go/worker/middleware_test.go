@@ -0,0 +1,126 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nochte/pipelinr-clients/go/pipe"
+	"github.com/nochte/pipelinr-protocol/protobuf/messages"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type traceKey struct{}
+
+func TestMiddleware(t *testing.T) {
+	Convey("Worker middleware", t, func() {
+		driver := newCountingDriver()
+		w := newMemoryWorker(driver, 5)
+		id, _ := w.Pipe().Send(`{}`, []string{w.Step()})
+		completed := func() bool {
+			return len(driver.Message(id).GetCompletedSteps()) > 0
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		Reset(cancel)
+
+		Convey("wraps the whole chain, first registered outermost", func() {
+			mu := sync.Mutex{}
+			order := make([]string, 0)
+			record := func(s string) {
+				mu.Lock()
+				defer mu.Unlock()
+				order = append(order, s)
+			}
+			named := func(name string) Middleware {
+				return func(next Handler) Handler {
+					return func(ctx context.Context, msg *messages.Event, p *pipe.Pipe) Outcome {
+						record(name + " in")
+						outcome := next(ctx, msg, p)
+						record(name + " out")
+						return outcome
+					}
+				}
+			}
+			w.Use(named("a"), named("b"))
+			w.OnMessage(func(msg *messages.Event, p *pipe.Pipe) error {
+				record("handler 0")
+				return nil
+			})
+			w.OnMessage(func(msg *messages.Event, p *pipe.Pipe) error {
+				record("handler 1")
+				return nil
+			})
+			go w.Run(ctx)
+
+			So(eventually(completed), ShouldBeTrue)
+			mu.Lock()
+			defer mu.Unlock()
+			So(order, ShouldResemble, []string{"a in", "b in", "handler 0", "handler 1", "b out", "a out"})
+		})
+
+		Convey("recovers panics into failures", func() {
+			w.Use(Recover(), func(next Handler) Handler {
+				return func(ctx context.Context, msg *messages.Event, p *pipe.Pipe) Outcome {
+					panic("boom")
+				}
+			})
+			w.SetFailureAction(ActionLeave)
+			errs := make(chan error, 1)
+			w.OnError(func(msg *messages.Event, er error, p *pipe.Pipe) {
+				errs <- er
+			})
+			w.OnMessage(func(msg *messages.Event, p *pipe.Pipe) error {
+				return nil
+			})
+			go w.Run(ctx)
+
+			er := <-errs
+			So(er.Error(), ShouldStartWith, "panic: boom")
+			So(er.Error(), ShouldContainSubstring, "middleware_test.go")
+			So(w.Stats().Panics, ShouldEqual, 1)
+		})
+
+		Convey("times and logs each message", func() {
+			timings := make(chan time.Duration, 1)
+			buf := &bytes.Buffer{}
+			w.Use(Timing(func(msg *messages.Event, outcome Outcome, elapsed time.Duration) {
+				timings <- elapsed
+			}), Logging(log.New(buf, "", 0)))
+			w.OnMessage(func(msg *messages.Event, p *pipe.Pipe) error {
+				time.Sleep(time.Millisecond * 10)
+				return errors.New("app fail")
+			})
+			go w.Run(ctx)
+
+			So(<-timings, ShouldBeGreaterThanOrEqualTo, time.Millisecond*10)
+			So(eventually(completed), ShouldBeTrue)
+			line := strings.TrimSpace(buf.String())
+			So(line, ShouldStartWith, `step="`+w.Step()+`" id=`+id+" action=fail elapsed=")
+			So(line, ShouldEndWith, `error="app fail"`)
+		})
+
+		Convey("traces each message", func() {
+			ended := make(chan Outcome, 1)
+			w.Use(Tracing(func(ctx context.Context, msg *messages.Event) (context.Context, func(Outcome)) {
+				return context.WithValue(ctx, traceKey{}, "trace-"+msg.GetStringId()), func(o Outcome) {
+					ended <- o
+				}
+			}))
+			traced := make(chan interface{}, 1)
+			w.OnMessageHandler(func(ctx context.Context, msg *messages.Event, p *pipe.Pipe) Outcome {
+				traced <- ctx.Value(traceKey{})
+				return SkipTo("elsewhere")
+			})
+			go w.Run(ctx)
+
+			So(<-traced, ShouldEqual, "trace-"+id)
+			So((<-ended).Action, ShouldEqual, ActionSkipTo)
+		})
+	})
+}
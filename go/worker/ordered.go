@@ -0,0 +1,109 @@
+package worker
+
+import (
+	"sync"
+
+	"github.com/nochte/pipelinr-protocol/protobuf/messages"
+	"github.com/tidwall/gjson"
+)
+
+// orderedBuffer is how many messages an ordered worker holds per concurrency slot, running or waiting
+//  behind another message with the same key, before it stops taking more
+const orderedBuffer = 4
+
+// SetOrderingKey has the worker handle messages with the same value at the gjson path of their payload
+//  one at a time, in the order they were received, while still handling messages with different keys
+//  concurrently. ex: SetOrderingKey("account.id"). Messages without a value there aren't ordered
+// It doesn't apply to a worker with a BatchHandler. It should be called before Run
+func (w *Worker) SetOrderingKey(path string) {
+	w.SetOrderingKeyFunc(func(msg *messages.Event) string {
+		return gjson.Get(payload(msg), path).String()
+	})
+}
+
+// SetOrderingKeyFunc is SetOrderingKey, with the key returned by key; an empty key isn't ordered
+func (w *Worker) SetOrderingKeyFunc(key func(*messages.Event) string) {
+	w.orderingKey = key
+}
+
+// keyQueues holds the messages waiting behind the one being handled for each key
+type keyQueues struct {
+	mu     sync.Mutex
+	queues map[string][]delivery
+}
+
+// push queues d behind its key, returning false if nothing with the key is being handled, in which
+//  case the caller is to handle it
+func (q *keyQueues) push(key string, d delivery) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	waiting, busy := q.queues[key]
+	if !busy {
+		q.queues[key] = nil
+		return false
+	}
+	q.queues[key] = append(waiting, d)
+	return true
+}
+
+// pop returns the next message waiting for key, or false once there are none
+func (q *keyQueues) pop(key string) (delivery, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	waiting := q.queues[key]
+	if len(waiting) == 0 {
+		delete(q.queues, key)
+		return delivery{}, false
+	}
+	q.queues[key] = waiting[1:]
+	return waiting[0], true
+}
+
+// consumeOrdered is consume for a worker with an ordering key, handling messages from ch until it is
+//  closed, one key at a time
+func (w *Worker) consumeOrdered(s *session, ch <-chan delivery, goroutines int) {
+	queues := &keyQueues{queues: make(map[string][]delivery)}
+	held := make(chan struct{}, goroutines*orderedBuffer)
+	wg := sync.WaitGroup{}
+	for {
+		held <- struct{}{}
+		d, ok := <-ch
+		if !ok {
+			break
+		}
+		key := w.orderingKey(d.msg)
+		if key != "" && queues.push(key, d) {
+			continue
+		}
+
+		wg.Add(1)
+		go func(key string, d delivery) {
+			defer wg.Done()
+			for {
+				w.handleOrdered(s, d)
+				<-held
+				if key == "" {
+					return
+				}
+				next, ok := queues.pop(key)
+				if !ok {
+					return
+				}
+				d = next
+			}
+		}(key, d)
+	}
+	wg.Wait()
+}
+
+// handleOrdered handles d when the limiter has room, unless it's abandoned or the batch is full
+func (w *Worker) handleOrdered(s *session, d delivery) {
+	s.limiter.acquire()
+	defer s.limiter.release()
+	if !s.abandoned() && s.batch.take() {
+		w.handle(s, d)
+		s.batch.done()
+	} else {
+		d.release()
+	}
+}
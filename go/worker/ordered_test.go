@@ -0,0 +1,74 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nochte/pipelinr-clients/go/pipe"
+	"github.com/nochte/pipelinr-protocol/protobuf/messages"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/tidwall/gjson"
+)
+
+func TestWorkerOrderingKey(t *testing.T) {
+	Convey("Worker with an ordering key", t, func() {
+		driver := newCountingDriver()
+		w := newMemoryWorker(driver, 20)
+		w.SetConcurrency(4)
+		w.SetOrderingKey("account")
+
+		ctx, cancel := context.WithCancel(context.Background())
+		Reset(cancel)
+
+		const accounts, perAccount = 5, 10
+		mu := sync.Mutex{}
+		seen := make(map[string][]int64)
+		var running, maxRunning int64
+		w.OnMessage(func(msg *messages.Event, p *pipe.Pipe) error {
+			now := atomic.AddInt64(&running, 1)
+			defer atomic.AddInt64(&running, -1)
+			for {
+				max := atomic.LoadInt64(&maxRunning)
+				if now <= max || atomic.CompareAndSwapInt64(&maxRunning, max, now) {
+					break
+				}
+			}
+
+			time.Sleep(time.Duration(rand.Intn(5000)) * time.Microsecond)
+			account := gjson.Get(msg.GetMessage().GetPayload(), "account").String()
+			mu.Lock()
+			seen[account] = append(seen[account], gjson.Get(msg.GetMessage().GetPayload(), "seq").Int())
+			mu.Unlock()
+			return nil
+		})
+
+		for seq := 0; seq < perAccount; seq++ {
+			for account := 0; account < accounts; account++ {
+				driver.Send(fmt.Sprintf(`{"account":"a%v","seq":%v}`, account, seq), []string{w.Step()})
+			}
+		}
+		unkeyed, _ := driver.Send(`{}`, []string{w.Step()})
+		go w.Run(ctx)
+
+		So(eventually(func() bool { return w.Stats().Completed == accounts*perAccount+1 }), ShouldBeTrue)
+		So(driver.Completes(unkeyed), ShouldEqual, 1)
+		So(atomic.LoadInt64(&maxRunning), ShouldBeGreaterThan, 1)
+		So(atomic.LoadInt64(&maxRunning), ShouldBeLessThanOrEqualTo, 4)
+
+		mu.Lock()
+		defer mu.Unlock()
+		So(len(seen), ShouldEqual, accounts+1)
+		for account := 0; account < accounts; account++ {
+			seqs := seen[fmt.Sprintf("a%v", account)]
+			So(len(seqs), ShouldEqual, perAccount)
+			for ndx := range seqs {
+				So(seqs[ndx], ShouldEqual, ndx)
+			}
+		}
+	})
+}
@@ -0,0 +1,138 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/nochte/pipelinr-clients/go/pipe"
+	"github.com/nochte/pipelinr-protocol/protobuf/messages"
+)
+
+// Handler handles a single message, returning the Outcome the worker should act on
+//  Handlers in the onMessage chain run in order until one returns anything other than Completed
+type Handler func(ctx context.Context, msg *messages.Event, p *pipe.Pipe) Outcome
+
+// Action is what the worker does with a message once its handlers have run
+type Action int
+
+const (
+	// ActionComplete logs success and completes the step, moving the message along its route
+	ActionComplete Action = iota
+	// ActionFail logs the error, runs the OnError handlers, then takes the worker's failure action
+	ActionFail
+	// ActionRetry logs the error and runs the handlers again after the outcome's Delay. Without a
+	//  Delay, the message is left for pipelinr to redeliver after its RedeliveryTimeout
+	ActionRetry
+	// ActionSkipTo routes the message to the outcome's Step next, then completes this step
+	ActionSkipTo
+	// ActionDeadLetter logs the error and routes the message to the dead-letter step next, then
+	//  completes this step
+	ActionDeadLetter
+	// ActionLeave leaves the message un-completed, so pipelinr redelivers it after its RedeliveryTimeout
+	ActionLeave
+)
+
+func (a Action) String() string {
+	switch a {
+	case ActionComplete:
+		return "complete"
+	case ActionFail:
+		return "fail"
+	case ActionRetry:
+		return "retry"
+	case ActionSkipTo:
+		return "skip"
+	case ActionDeadLetter:
+		return "dead-letter"
+	case ActionLeave:
+		return "leave"
+	}
+	return "unknown"
+}
+
+// Outcome is the result of handling a message
+type Outcome struct {
+	Action Action
+	// Err is why the message wasn't completed, and is written to the route log
+	Err error
+	// Delay is how long to wait before an ActionRetry
+	Delay time.Duration
+	// Step is where ActionSkipTo routes the message, and overrides the worker's dead-letter step for ActionDeadLetter
+	Step string
+
+	// handler is 1 + the index of the onMessage handler that returned this outcome, 0 if unknown, or
+	//  batchSource for the BatchHandler
+	handler int
+}
+
+// batchSource marks outcomes returned by the worker's BatchHandler
+const batchSource = -1
+
+// source names what produced the outcome, for the route log
+func (o Outcome) source() string {
+	if o.handler == batchSource {
+		return "batch handler"
+	}
+	if o.handler > 0 {
+		return fmt.Sprintf("handler %v", o.handler-1)
+	}
+	return "middleware"
+}
+
+// Completed returns an Outcome that completes the message, or lets the next handler in the chain run
+func Completed() Outcome {
+	return Outcome{Action: ActionComplete}
+}
+
+// Fail returns an Outcome for a failed handler, which the worker treats like a handler returning er
+func Fail(er error) Outcome {
+	return Outcome{Action: ActionFail, Err: er}
+}
+
+// RetryAfter returns an Outcome that runs the handlers again after delay
+func RetryAfter(delay time.Duration, er error) Outcome {
+	return Outcome{Action: ActionRetry, Err: er, Delay: delay}
+}
+
+// SkipTo returns an Outcome that routes the message to step next
+func SkipTo(step string) Outcome {
+	return Outcome{Action: ActionSkipTo, Step: step}
+}
+
+// DeadLetter returns an Outcome that routes the message to the worker's dead-letter step
+func DeadLetter(er error) Outcome {
+	return Outcome{Action: ActionDeadLetter, Err: er}
+}
+
+// Leave returns an Outcome that leaves the message for redelivery, logging er if it isn't nil
+func Leave(er error) Outcome {
+	return Outcome{Action: ActionLeave, Err: er}
+}
+
+// handlerFunc adapts an OnMessage callback into a Handler
+func handlerFunc(fn func(*messages.Event, *pipe.Pipe) error) Handler {
+	return func(ctx context.Context, msg *messages.Event, p *pipe.Pipe) Outcome {
+		if er := fn(msg, p); er != nil {
+			return Fail(er)
+		}
+		return Completed()
+	}
+}
+
+// detached is a context that carries its parent's values, but not its cancellation
+type detached struct {
+	context.Context
+}
+
+func (detached) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detached) Done() <-chan struct{} {
+	return nil
+}
+
+func (detached) Err() error {
+	return nil
+}
@@ -0,0 +1,44 @@
+package worker
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nochte/pipelinr-clients/go/pipe"
+	"github.com/nochte/pipelinr-protocol/protobuf/messages"
+)
+
+// SetRetrySchedule has the worker retry a failed message after each of delays in turn, ex: 10s, 1m,
+//  10m, before giving up and taking its failure action. It applies to handlers that fail, or that
+//  return an ActionRetry without a Delay
+// The message is held while it waits, without taking up a concurrency slot, and each retry is written
+//  to its route log with a negative code, so a redelivered message picks the schedule up where it left
+//  off. Delays longer than the pipe's RedeliveryTimeout need SetLeaseExtension, or the message is
+//  redelivered instead
+func (w *Worker) SetRetrySchedule(delays ...time.Duration) {
+	w.retrySchedule = delays
+}
+
+// scheduleRetry turns a failed outcome into an ActionRetry after the next delay in the retry schedule,
+//  returning the retry's number, or 0 if the outcome was left as it was
+//  retries is how many times the message has already been retried since it was delivered
+func (w *Worker) scheduleRetry(msg *messages.Event, p *pipe.Pipe, outcome Outcome, retries int) (Outcome, int) {
+	if outcome.Action != ActionFail && (outcome.Action != ActionRetry || outcome.Delay > 0) {
+		return outcome, 0
+	}
+	attempt := w.failures(msg, p) + retries
+	if attempt >= len(w.retrySchedule) {
+		return outcome, 0
+	}
+	outcome.Action = ActionRetry
+	outcome.Delay = w.retrySchedule[attempt]
+	return outcome, attempt + 1
+}
+
+// retryMessage is the route log entry for a retry
+func (w *Worker) retryMessage(outcome Outcome, attempt int) string {
+	if attempt > 0 {
+		return fmt.Sprintf("%v will retry in %v (retry %v of %v), with error %v", outcome.source(), outcome.Delay, attempt, len(w.retrySchedule), errString(outcome.Err))
+	}
+	return fmt.Sprintf("%v will retry in %v, with error %v", outcome.source(), outcome.Delay, errString(outcome.Err))
+}
@@ -0,0 +1,215 @@
+package worker
+
+import (
+	"reflect"
+	"time"
+
+	"github.com/nochte/pipelinr-clients/go/pipe"
+	"github.com/nochte/pipelinr-protocol/protobuf/messages"
+)
+
+// Candidate is a pipe with a message waiting for a handler
+type Candidate struct {
+	// Index is the pipe's position in the worker's Pipes
+	Index    int
+	Step     string
+	Priority int
+	// Waiting is how long the message has been waiting
+	Waiting time.Duration
+}
+
+// Scheduler decides which of a worker's pipes the next message is handled from
+//  A worker calls its scheduler from a single goroutine
+type Scheduler interface {
+	// Pick returns the position in candidates of the message to hand to a handler next
+	Pick(candidates []Candidate) int
+	// Handed is called once the message from the pipe at index has been handed to a handler
+	Handed(index int)
+}
+
+// SetScheduler sets how the worker chooses between its pipes, see RoundRobin (the default),
+//  StrictPriority and WeightedPriority. It should be called before Run
+func (w *Worker) SetScheduler(scheduler Scheduler) {
+	w.scheduler = scheduler
+}
+
+// SetPriority sets the priority of one of the worker's pipes, for StrictPriority and WeightedPriority
+//  Pipes default to a priority of 1
+// Messages a pipe has fetched wait in its Chan until they are scheduled, so a low priority pipe's
+//  Count should be kept small, or its messages may be redelivered while they wait
+func (w *Worker) SetPriority(p *pipe.Pipe, priority int) {
+	for ndx := range w.pipes {
+		if w.pipes[ndx] == p {
+			w.priorities[ndx] = priority
+		}
+	}
+}
+
+type roundRobin struct {
+	last int
+}
+
+// RoundRobin returns a Scheduler that takes messages from each pipe in turn, ignoring priorities
+func RoundRobin() Scheduler {
+	return &roundRobin{last: -1}
+}
+
+func (s *roundRobin) Pick(candidates []Candidate) int {
+	pick := 0
+	for ndx, c := range candidates {
+		if c.Index > s.last {
+			return ndx
+		}
+		if c.Index < candidates[pick].Index {
+			pick = ndx
+		}
+	}
+	return pick
+}
+
+func (s *roundRobin) Handed(index int) {
+	s.last = index
+}
+
+type strictPriority struct {
+	maxWait time.Duration
+}
+
+// StrictPriority returns a Scheduler that always takes from the highest priority pipe with a message
+//  waiting, ex: to drain billing-urgent before billing. To keep lower priorities from starving, a
+//  message that has waited longer than maxWait goes first, oldest first; 0 lets them starve
+func StrictPriority(maxWait time.Duration) Scheduler {
+	return &strictPriority{maxWait: maxWait}
+}
+
+func (s *strictPriority) Pick(candidates []Candidate) int {
+	pick := 0
+	starving := false
+	for ndx, c := range candidates {
+		best := candidates[pick]
+		switch {
+		case s.maxWait > 0 && c.Waiting > s.maxWait:
+			if !starving || c.Waiting > best.Waiting {
+				pick, starving = ndx, true
+			}
+		case starving:
+		case c.Priority > best.Priority || (c.Priority == best.Priority && c.Waiting > best.Waiting):
+			pick = ndx
+		}
+	}
+	return pick
+}
+
+func (s *strictPriority) Handed(index int) {}
+
+type weightedPriority struct {
+	current    map[int]int
+	candidates []Candidate
+}
+
+// WeightedPriority returns a Scheduler that shares handlers between pipes in proportion to their
+//  priorities, ex: a pipe with priority 3 gets 3 messages handled for each 1 from a pipe with priority
+//  1, while both have messages waiting. No pipe with messages waiting is starved
+func WeightedPriority() Scheduler {
+	return &weightedPriority{current: make(map[int]int)}
+}
+
+// Pick is a smooth weighted round robin, which interleaves the pipes rather than handing out bursts
+func (s *weightedPriority) Pick(candidates []Candidate) int {
+	s.candidates = candidates
+	pick := 0
+	for ndx, c := range candidates {
+		best := candidates[pick]
+		if s.current[c.Index]+weight(c) > s.current[best.Index]+weight(best) {
+			pick = ndx
+		}
+	}
+	return pick
+}
+
+func (s *weightedPriority) Handed(index int) {
+	total := 0
+	for _, c := range s.candidates {
+		s.current[c.Index] += weight(c)
+		total += weight(c)
+	}
+	s.current[index] -= total
+}
+
+func weight(c Candidate) int {
+	if c.Priority < 1 {
+		return 1
+	}
+	return c.Priority
+}
+
+// dispatch hands the messages from the worker's pipes to out one at a time, in the order its scheduler
+//  picks them, closing out once every pipe's Chan is closed, or once abandon is. It holds at most one
+//  message per pipe, so the scheduler can choose among the pipes with messages waiting, and holds each
+//  message's lease from when it takes it
+func (w *Worker) dispatch(out chan<- delivery, abandon <-chan struct{}) {
+	chans := make([]<-chan *messages.Event, len(w.pipes))
+	for ndx := range w.pipes {
+		chans[ndx] = w.pipes[ndx].Chan()
+	}
+	heads := make([]*delivery, len(w.pipes))
+
+	for {
+		cases := make([]reflect.SelectCase, 0, len(chans)+2)
+		receiving := make([]int, 0, len(chans))
+		candidates := make([]Candidate, 0, len(chans))
+		for ndx := range chans {
+			if heads[ndx] != nil {
+				candidates = append(candidates, Candidate{
+					Index:    ndx,
+					Step:     w.pipes[ndx].Step(),
+					Priority: w.priorities[ndx],
+					Waiting:  time.Since(heads[ndx].at),
+				})
+			} else if chans[ndx] != nil {
+				cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(chans[ndx])})
+				receiving = append(receiving, ndx)
+			}
+		}
+		if len(cases) == 0 && len(candidates) == 0 {
+			close(out)
+			return
+		}
+
+		pick := -1
+		if len(candidates) > 0 {
+			pick = candidates[w.scheduler.Pick(candidates)].Index
+			cases = append(cases, reflect.SelectCase{
+				Dir:  reflect.SelectSend,
+				Chan: reflect.ValueOf(out),
+				Send: reflect.ValueOf(*heads[pick]),
+			})
+		}
+
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(abandon)})
+
+		chosen, value, ok := reflect.Select(cases)
+		if chosen == len(cases)-1 {
+			// the held messages are left for redelivery
+			for _, head := range heads {
+				if head != nil {
+					head.release()
+				}
+			}
+			close(out)
+			return
+		}
+		if chosen == len(receiving) {
+			heads[pick] = nil
+			w.scheduler.Handed(pick)
+			continue
+		}
+		ndx := receiving[chosen]
+		if !ok {
+			chans[ndx] = nil
+			continue
+		}
+		msg, at := value.Interface().(*messages.Event), time.Now()
+		heads[ndx] = &delivery{msg: msg, pipe: w.pipes[ndx], at: at, release: w.holdLease(msg, w.pipes[ndx], at)}
+	}
+}
@@ -0,0 +1,109 @@
+package worker
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nochte/pipelinr-clients/go/lib"
+	"github.com/nochte/pipelinr-clients/go/pipe"
+	"github.com/nochte/pipelinr-protocol/protobuf/messages"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func candidates(priorities []int, waiting []time.Duration) []Candidate {
+	out := make([]Candidate, 0, len(priorities))
+	for ndx := range priorities {
+		out = append(out, Candidate{Index: ndx, Priority: priorities[ndx], Waiting: waiting[ndx]})
+	}
+	return out
+}
+
+func TestSchedulers(t *testing.T) {
+	Convey("Schedulers", t, func() {
+		Convey("RoundRobin takes each pipe in turn", func() {
+			s := RoundRobin()
+			all := candidates([]int{1, 9, 1}, make([]time.Duration, 3))
+			So(s.Pick(all), ShouldEqual, 0)
+			s.Handed(0)
+			So(s.Pick(all), ShouldEqual, 1)
+			s.Handed(1)
+			So(s.Pick([]Candidate{all[0], all[1]}), ShouldEqual, 0)
+			So(s.Pick([]Candidate{all[0], all[2]}), ShouldEqual, 1)
+			s.Handed(2)
+			So(s.Pick(all), ShouldEqual, 0)
+		})
+
+		Convey("StrictPriority takes the highest priority", func() {
+			all := candidates([]int{1, 5, 5}, []time.Duration{time.Second, time.Millisecond * 10, time.Millisecond * 20})
+			So(StrictPriority(0).Pick(all), ShouldEqual, 2)
+
+			Convey("unless a message has waited too long", func() {
+				So(StrictPriority(time.Millisecond*500).Pick(all), ShouldEqual, 0)
+			})
+		})
+
+		Convey("WeightedPriority shares in proportion to priority", func() {
+			s := WeightedPriority()
+			all := candidates([]int{3, 1}, make([]time.Duration, 2))
+			picks := make([]int, 0)
+			for i := 0; i < 8; i++ {
+				pick := all[s.Pick(all)].Index
+				s.Handed(pick)
+				picks = append(picks, pick)
+			}
+			So(picks, ShouldResemble, []int{0, 0, 1, 0, 0, 0, 1, 0})
+		})
+	})
+}
+
+func TestWorkerPriority(t *testing.T) {
+	Convey("Worker with prioritised pipes", t, func() {
+		driver := newCountingDriver()
+		w := newMemoryWorker(driver, 2)
+		urgent := pipe.New(driver, lib.GenerateRandomString(8))
+		i32two, i64hundred := int32(2), int64(100)
+		urgent.SetReceiveOptions(&i32two, nil, &i64hundred, nil, nil, nil, nil, nil)
+		w.AddPipe(urgent)
+		w.SetPriority(urgent, 10)
+		w.SetScheduler(StrictPriority(0))
+
+		for i := 0; i < 10; i++ {
+			driver.Send(`{}`, []string{w.Step()})
+			driver.Send(`{}`, []string{urgent.Step()})
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		Reset(cancel)
+
+		mu := sync.Mutex{}
+		handled := make([]string, 0)
+		w.OnMessageHandler(func(ctx context.Context, msg *messages.Event, p *pipe.Pipe) Outcome {
+			mu.Lock()
+			first := len(handled) == 0
+			handled = append(handled, p.Step())
+			mu.Unlock()
+			if first {
+				// let both pipes fill up
+				time.Sleep(time.Millisecond * 50)
+			}
+			time.Sleep(time.Millisecond * 2)
+			return Completed()
+		})
+		go w.Run(ctx)
+
+		So(eventually(func() bool { return w.Stats().Completed == 20 }), ShouldBeTrue)
+		mu.Lock()
+		defer mu.Unlock()
+		// the first message, and the next one taken while it's handled, may be from the normal pipe if
+		//  the urgent one hasn't delivered yet
+		normal := 0
+		for _, step := range handled[:12] {
+			if step == w.Step() {
+				normal++
+			}
+		}
+		So(normal, ShouldBeLessThanOrEqualTo, 2)
+	})
+}
@@ -0,0 +1,109 @@
+package worker
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync/atomic"
+)
+
+// Stats counts what a worker has done with its messages
+type Stats struct {
+	// Handled is the number of messages run through the handlers
+	Handled uint64
+	// Completed is the number of messages completed, including skipped and dead-lettered ones
+	Completed uint64
+	// Failed is the number of messages whose handlers failed
+	Failed uint64
+	// Retried is the number of retries handlers asked for
+	Retried uint64
+	// DeadLettered is the number of messages routed to a dead-letter step
+	DeadLettered uint64
+	// Left is the number of messages left for redelivery
+	Left uint64
+	// Panics is the number of panics recovered from handlers and middleware
+	Panics uint64
+	// Timeouts is the number of messages whose handlers ran past their deadline
+	Timeouts uint64
+	// LeaseRenewals is the number of times the lease on a held message was renewed
+	LeaseRenewals uint64
+	// LeasesExpired is the number of messages still being handled when their max lease ran out
+	LeasesExpired uint64
+	// Duplicates is the number of messages found to be already completed at this step, by the dedup
+	//  store or by pipelinr
+	Duplicates uint64
+	// Uncompleted is the number of messages that couldn't be completed, even after retrying, and are
+	//  left for redelivery
+	Uncompleted uint64
+}
+
+// Stats returns a snapshot of the worker's counters
+func (w *Worker) Stats() Stats {
+	return Stats{
+		Handled:       atomic.LoadUint64(&w.stats.Handled),
+		Completed:     atomic.LoadUint64(&w.stats.Completed),
+		Failed:        atomic.LoadUint64(&w.stats.Failed),
+		Retried:       atomic.LoadUint64(&w.stats.Retried),
+		DeadLettered:  atomic.LoadUint64(&w.stats.DeadLettered),
+		Left:          atomic.LoadUint64(&w.stats.Left),
+		Panics:        atomic.LoadUint64(&w.stats.Panics),
+		Timeouts:      atomic.LoadUint64(&w.stats.Timeouts),
+		LeaseRenewals: atomic.LoadUint64(&w.stats.LeaseRenewals),
+		LeasesExpired: atomic.LoadUint64(&w.stats.LeasesExpired),
+		Duplicates:    atomic.LoadUint64(&w.stats.Duplicates),
+		Uncompleted:   atomic.LoadUint64(&w.stats.Uncompleted),
+	}
+}
+
+// add returns the sum of two snapshots
+func (s Stats) add(o Stats) Stats {
+	return Stats{
+		Handled:       s.Handled + o.Handled,
+		Completed:     s.Completed + o.Completed,
+		Failed:        s.Failed + o.Failed,
+		Retried:       s.Retried + o.Retried,
+		DeadLettered:  s.DeadLettered + o.DeadLettered,
+		Left:          s.Left + o.Left,
+		Panics:        s.Panics + o.Panics,
+		Timeouts:      s.Timeouts + o.Timeouts,
+		LeaseRenewals: s.LeaseRenewals + o.LeaseRenewals,
+		LeasesExpired: s.LeasesExpired + o.LeasesExpired,
+		Duplicates:    s.Duplicates + o.Duplicates,
+		Uncompleted:   s.Uncompleted + o.Uncompleted,
+	}
+}
+
+// sub returns the difference between two snapshots, ex: the counts since before was taken
+func (s Stats) sub(before Stats) Stats {
+	return Stats{
+		Handled:       s.Handled - before.Handled,
+		Completed:     s.Completed - before.Completed,
+		Failed:        s.Failed - before.Failed,
+		Retried:       s.Retried - before.Retried,
+		DeadLettered:  s.DeadLettered - before.DeadLettered,
+		Left:          s.Left - before.Left,
+		Panics:        s.Panics - before.Panics,
+		Timeouts:      s.Timeouts - before.Timeouts,
+		LeaseRenewals: s.LeaseRenewals - before.LeaseRenewals,
+		LeasesExpired: s.LeasesExpired - before.LeasesExpired,
+		Duplicates:    s.Duplicates - before.Duplicates,
+		Uncompleted:   s.Uncompleted - before.Uncompleted,
+	}
+}
+
+// PanicError is the error a recovered panic is turned into
+type PanicError struct {
+	// Value is what was passed to panic
+	Value interface{}
+	// Stack is the stack trace of the panicking goroutine
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v\n%s", e.Value, e.Stack)
+}
+
+// recovered turns a recovered panic value into a Fail outcome, counting it in the worker's stats
+func (w *Worker) recovered(r interface{}) Outcome {
+	atomic.AddUint64(&w.stats.Panics, 1)
+	return Fail(&PanicError{Value: r, Stack: debug.Stack()})
+}
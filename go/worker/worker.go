@@ -1,27 +1,96 @@
 package worker
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/nochte/pipelinr-clients/go/lib/retry"
 	"github.com/nochte/pipelinr-clients/go/pipe"
+	"github.com/nochte/pipelinr-clients/go/pipe/drivers"
 	"github.com/nochte/pipelinr-protocol/protobuf/messages"
 )
 
+// DrainPolicy decides what a stopping Worker does with messages that were fetched but not yet handled
+type DrainPolicy int
+
+const (
+	// DrainProcess handles buffered messages as usual, until the drain timeout
+	DrainProcess DrainPolicy = iota
+	// DrainAbandon leaves buffered messages un-completed, so pipelinr redelivers them after their RedeliveryTimeout
+	DrainAbandon
+)
+
+const (
+	// LogCodeCompleted is the route log code for a completed step
+	LogCodeCompleted int32 = 0
+	// LogCodeFailed is the route log code for a failed attempt at a step
+	LogCodeFailed int32 = -1
+	// LogCodeRouted is the route log code for a message routed to another step by SkipTo or a dead-letter
+	LogCodeRouted int32 = 1
+)
+
 type Worker struct {
-	pipe      *pipe.Pipe
-	onMessage []func(*messages.Event, *pipe.Pipe) error
-	onError   []func(*messages.Event, error, *pipe.Pipe)
+	stats          Stats
+	pipe           *pipe.Pipe
+	pipes          []*pipe.Pipe
+	priorities     []int
+	scheduler      Scheduler
+	onMessage      []Handler
+	routes         *router
+	batchHandler   BatchHandler
+	batchSize      int
+	batchWindow    time.Duration
+	orderingKey    func(*messages.Event) string
+	completion     *AsyncCompletion
+	apiRetry       retry.Policy
+	retryBudget    *retry.Budget
+	middleware     []Middleware
+	onError        []func(*messages.Event, error, *pipe.Pipe)
+	failureAction  Action
+	deadLetterStep string
+	handlerTimeout time.Duration
+	timeoutAction  Action
+	concurrency    int
+	drainTimeout   time.Duration
+	drainPolicy    DrainPolicy
+	leaseExtension bool
+	leaseInterval  time.Duration
+	maxLease       time.Duration
+	maxFailures    int
+	maxFailureStep string
+	retrySchedule  []time.Duration
+	autoscale      *Autoscale
+	dedup          DedupStore
+	dedupAction    Action
+
+	mu        sync.Mutex
 	running   bool
+	cancel    context.CancelFunc
+	limiter   *limiter
+	completer *completer
+	// apiCtx bounds the retries of API calls, until the run's handlers are cancelled
+	apiCtx context.Context
 }
 
 func New(p *pipe.Pipe) *Worker {
 	return &Worker{
-		pipe:      p,
-		onMessage: make([]func(*messages.Event, *pipe.Pipe) error, 0, 1),
-		onError:   make([]func(*messages.Event, error, *pipe.Pipe), 0, 1),
-		running:   false}
+		pipe:          p,
+		pipes:         []*pipe.Pipe{p},
+		priorities:    []int{1},
+		scheduler:     RoundRobin(),
+		onMessage:     make([]Handler, 0, 1),
+		onError:       make([]func(*messages.Event, error, *pipe.Pipe), 0, 1),
+		failureAction: ActionFail,
+		timeoutAction: ActionLeave,
+		concurrency:   1,
+		drainTimeout:  30 * time.Second,
+		drainPolicy:   DrainProcess,
+		apiRetry:      retry.Policy{Backoff: retry.DecorrelatedJitter(100*time.Millisecond, 5*time.Second), MaxAttempts: 10},
+		running:       false}
 }
 
 func NewHTTP(step, apikey, url string) *Worker {
@@ -32,23 +101,124 @@ func NewGRPC(step, apikey, url string) *Worker {
 	return New(pipe.NewGRPC(url, apikey, step))
 }
 
-func (w Worker) Pipe() *pipe.Pipe {
+// Pipe returns the worker's first pipe
+func (w *Worker) Pipe() *pipe.Pipe {
 	return w.pipe
 }
 
-func (w Worker) Name() string {
+// Pipes returns every pipe the worker consumes
+func (w *Worker) Pipes() []*pipe.Pipe {
+	return append([]*pipe.Pipe{}, w.pipes...)
+}
+
+// AddPipe has the worker consume p as well, ex: for another step that shares its handlers. Messages
+//  from each pipe are handled in the order the worker's Scheduler picks, and are acked, completed and
+//  logged through the pipe they came from. Each pipe keeps its own receive options. It should be
+//  called before Run
+func (w *Worker) AddPipe(p *pipe.Pipe) {
+	w.pipes = append(w.pipes, p)
+	w.priorities = append(w.priorities, 1)
+	if w.retryBudget != nil {
+		p.SetRetryBudget(w.retryBudget)
+	}
+}
+
+func (w *Worker) Name() string {
 	return w.pipe.Name()
 }
 
-func (w Worker) Step() string {
+func (w *Worker) Step() string {
 	return w.pipe.Name()
 }
 
-func (w Worker) SetReceiveOptions(count *int32, timeout *int64, redeliveryTimeout *int64, autoAck, block, excludeRouting, excludeRouteLog, excludeDecoratedPayload *bool) {
-	w.pipe.SetReceiveOptions(count, timeout, redeliveryTimeout, autoAck, block, excludeRouting, excludeRouteLog, excludeDecoratedPayload)
+// SetReceiveOptions sets the receive options of every pipe the worker has, see pipe.SetReceiveOptions
+func (w *Worker) SetReceiveOptions(count *int32, timeout *int64, redeliveryTimeout *int64, autoAck, block, excludeRouting, excludeRouteLog, excludeDecoratedPayload *bool) {
+	for _, p := range w.pipes {
+		p.SetReceiveOptions(count, timeout, redeliveryTimeout, autoAck, block, excludeRouting, excludeRouteLog, excludeDecoratedPayload)
+	}
+}
+
+// SetConcurrency sets how many messages the worker handles at once, defaulting to 1
+//  Each message still runs through the whole onMessage chain on a single goroutine, but handlers
+//  must be safe to call concurrently for different messages. The receive options' Count should be at
+//  least n to keep every goroutine busy. It should be called before Run
+func (w *Worker) SetConcurrency(n int) {
+	if n < 1 {
+		n = 1
+	}
+	w.concurrency = n
+}
+
+// SetDrain sets how long a stopping worker waits for in-flight handlers, and what it does with
+//  messages it has fetched but not yet handled. Defaults to 30 seconds and DrainProcess
+func (w *Worker) SetDrain(timeout time.Duration, policy DrainPolicy) {
+	w.drainTimeout = timeout
+	w.drainPolicy = policy
+}
+
+// SetFailureAction sets what the worker does with a message after a handler fails (returns an error
+//  or Fail) and the OnError handlers have run: ActionComplete, ActionLeave or ActionDeadLetter
+//  The default, ActionFail, completes the message unless OnError handlers are registered, in which
+//  case they are responsible for it
+func (w *Worker) SetFailureAction(action Action) {
+	w.failureAction = action
 }
 
+// SetHandlerTimeout sets how long the handlers get for each message, and what the worker does with a
+//  message whose handlers ran past it without completing: ActionLeave (the default), ActionComplete,
+//  ActionFail or ActionDeadLetter. A timeout of 0 derives it from the pipe's RedeliveryTimeout, so
+//  handlers can stop before the message is redelivered to another worker
+func (w *Worker) SetHandlerTimeout(timeout time.Duration, action Action) {
+	w.handlerTimeout = timeout
+	w.timeoutAction = action
+}
+
+// SetDeadLetterStep sets the step that ActionDeadLetter routes messages to
+func (w *Worker) SetDeadLetterStep(step string) {
+	w.deadLetterStep = step
+}
+
+// SetMaxFailures has the worker dead-letter a message instead of handling it once it has failed n
+//  times at this step, counting its route log entries for the step with negative codes. It's routed
+//  to step, or the worker's dead-letter step if step is empty. An n of 0, the default, never gives up
+// The receive options must not exclude the route log
+func (w *Worker) SetMaxFailures(n int, step string) {
+	w.maxFailures = n
+	w.maxFailureStep = step
+}
+
+// SetAPIRetry sets how the worker retries its pipelinr API calls: logging, completing and routing
+//  messages. Retries stop once a stopping worker's drain timeout has passed. It should be called before Run
+func (w *Worker) SetAPIRetry(policy retry.Policy) {
+	w.apiRetry = policy
+}
+
+// SetRetryBudget has the worker's API calls, and its pipes, spend their retries from budget, which is
+//  usually shared with other workers, unless their retry policies have budgets of their own
+//  It should be called before Run
+func (w *Worker) SetRetryBudget(budget *retry.Budget) {
+	w.retryBudget = budget
+	for _, p := range w.pipes {
+		p.SetRetryBudget(budget)
+	}
+}
+
+// SetDedupStore has the worker record each message it completes in store, and check it before handling
+//  a message, so a redelivered duplicate isn't handled twice. Duplicates are completed again with
+//  ActionComplete, or skipped with ActionLeave. Errors from the store are reported to the OnError
+//  handlers, and the message is handled as usual
+func (w *Worker) SetDedupStore(store DedupStore, duplicate Action) {
+	w.dedup = store
+	w.dedupAction = duplicate
+}
+
+// OnMessage adds a handler to the onMessage chain; returning an error stops the chain and fails the message
 func (w *Worker) OnMessage(in func(*messages.Event, *pipe.Pipe) error) {
+	w.onMessage = append(w.onMessage, handlerFunc(in))
+}
+
+// OnMessageHandler adds a Handler to the onMessage chain, which decides the message's Outcome
+func (w *Worker) OnMessageHandler(in Handler) {
 	w.onMessage = append(w.onMessage, in)
 }
 
@@ -56,60 +226,516 @@ func (w *Worker) OnError(in func(*messages.Event, error, *pipe.Pipe)) {
 	w.onError = append(w.onError, in)
 }
 
+// Pause stops the worker fetching messages from its pipes until Resume is called, while in-flight
+//  messages, and those already fetched, are still handled. A worker paused before Run starts paused
+func (w *Worker) Pause() {
+	for _, p := range w.pipes {
+		p.Pause()
+	}
+}
+
+// Resume has a paused worker fetch messages again
+func (w *Worker) Resume() {
+	for _, p := range w.pipes {
+		p.Resume()
+	}
+}
+
+// Paused returns whether the worker is paused
+func (w *Worker) Paused() bool {
+	for _, p := range w.pipes {
+		if !p.Paused() {
+			return false
+		}
+	}
+	return true
+}
+
+// Stop stops a running worker, the same as cancelling the context given to Run
 func (w *Worker) Stop() {
-	w.running = false
-	w.pipe.Stop()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.cancel != nil {
+		w.cancel()
+	}
+}
+
+// Run starts the worker's pipe and handles its messages until ctx is done or the worker is stopped
+//  On shutdown it stops fetching, then gives in-flight handlers (and buffered messages, under
+//  DrainProcess) up to the drain timeout to finish
+// Run returns nil on a clean shutdown, and an error wrapping the cause otherwise: ex: the pipe failing,
+//  or context.DeadlineExceeded when handlers were still running at the drain timeout
+func (w *Worker) Run(ctx context.Context) error {
+	return w.run(ctx, nil)
 }
 
-func (w *Worker) Run() error {
+// run is Run, handling no more messages than b allows if it isn't nil
+func (w *Worker) run(ctx context.Context, b *batch) error {
+	w.mu.Lock()
 	if w.running {
+		w.mu.Unlock()
 		return errors.New("already running")
 	}
 	w.running = true
+	ctx, w.cancel = context.WithCancel(ctx)
+	w.mu.Unlock()
+
+	defer func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		w.cancel()
+		w.running = false
+	}()
+
+	for _, p := range w.pipes {
+		if er := p.Reset(); er != nil {
+			return fmt.Errorf("worker pipe stopped: %w", er)
+		}
+	}
+	pipectx, stopPipes := context.WithCancel(context.Background())
+	defer stopPipes()
+	piperr := make(chan error, 1)
+	pipewg := sync.WaitGroup{}
+	for _, p := range w.pipes {
+		pipewg.Add(1)
+		go func(p *pipe.Pipe) {
+			defer pipewg.Done()
+			if er := p.Start(pipectx); er != nil && pipectx.Err() == nil {
+				// one pipe failing stops them all, rather than leaving the worker running short
+				select {
+				case piperr <- er:
+					stopPipes()
+				default:
+				}
+			}
+		}(p)
+	}
+
+	hctx, cancelHandlers := context.WithCancel(detached{ctx})
+	defer cancelHandlers()
+	w.mu.Lock()
+	w.apiCtx = hctx
+	w.mu.Unlock()
+	s := &session{
+		handler:  w.chain(),
+		ctx:      hctx,
+		stopping: ctx.Done(),
+		abandon:  make(chan struct{}),
+		limiter:  newLimiter(w.startingConcurrency()),
+		batch:    b,
+	}
+	if w.completion != nil {
+		s.completer = w.startCompleter()
+	}
+	w.mu.Lock()
+	w.limiter = s.limiter
+	w.completer = s.completer
+	w.mu.Unlock()
+	if w.autoscale != nil {
+		go w.runAutoscale(ctx, s.limiter)
+	}
+	done, dispatched := make(chan struct{}), make(chan struct{})
 	go func() {
-		if er := w.pipe.Start(0); er != nil {
-			w.Stop()
+		defer close(done)
+		ch := make(chan delivery)
+		go func() {
+			defer close(dispatched)
+			w.dispatch(ch, s.abandon)
+		}()
+		w.consume(s, ch)
+		if s.completer != nil {
+			s.completer.close()
 		}
 	}()
 
-	ch := w.pipe.Chan()
+	select {
+	case <-done:
+		pipewg.Wait()
+		select {
+		case er := <-piperr:
+			return fmt.Errorf("worker pipe stopped: %w", er)
+		default:
+			return nil
+		}
+	case <-ctx.Done():
+	}
 
-	for w.running {
-		msg := <-ch
+	stopPipes()
+	if w.drainPolicy == DrainAbandon {
+		s.abandonBuffered()
+	}
 
-		shouldcomplete := true
-		keepon := true
+	timer := time.NewTimer(w.drainTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return nil
+	case <-timer.C:
+		s.abandonBuffered()
+		cancelHandlers()
+		// the handlers may outlive Run, but not the pipes or the scheduler, which the next Run reuses
+		<-dispatched
+		pipewg.Wait()
+		return fmt.Errorf("worker drain: %w", context.DeadlineExceeded)
+	}
+}
 
-		for ndx := range w.onMessage {
-			if !keepon {
-				continue
-			}
+// session is the state shared by the goroutines of a single Run
+type session struct {
+	// handler is the onMessage chain wrapped in middleware
+	handler Handler
+	// ctx is given to handlers; it outlives shutdown, and is cancelled at the drain timeout
+	ctx context.Context
+	// stopping is closed once shutdown begins
+	stopping <-chan struct{}
+	// abandon is closed once buffered messages should be left for redelivery
+	abandon     chan struct{}
+	abandonOnce sync.Once
+	// limiter caps how many messages are handled at once
+	limiter *limiter
+	// batch, if set, limits how many messages are handled in all
+	batch *batch
+	// completer, if set, completes messages in the background
+	completer *completer
+}
 
-			if er := w.onMessage[ndx](msg, w.pipe); er != nil {
-				keepon = false
-				retry.Do(func() error {
-					return w.pipe.Log(msg.GetStringId(), -1, fmt.Sprintf("failed to run handler %v, with error %v", ndx, er.Error()))
-				}, 40, 250)
+func (s *session) abandonBuffered() {
+	s.abandonOnce.Do(func() { close(s.abandon) })
+}
 
-				if len(w.onError) > 0 {
-					shouldcomplete = false
-				}
+func (s *session) abandoned() bool {
+	select {
+	case <-s.abandon:
+		return true
+	default:
+		return false
+	}
+}
 
-				for ndy := range w.onError {
-					w.onError[ndy](msg, er, w.pipe)
-				}
+// pause waits d before a retry, giving up its concurrency slot meanwhile so other messages are handled
+//  It returns false, once it has a slot again, if ctx is done or the worker begins stopping first
+func (s *session) pause(ctx context.Context, d time.Duration) bool {
+	s.limiter.release()
+	defer s.limiter.acquire()
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	case <-s.stopping:
+		return false
+	}
+}
+
+// delivery is a message, and the pipe it came from
+type delivery struct {
+	msg  *messages.Event
+	pipe *pipe.Pipe
+	// at is when the worker took msg from the pipe, which its deadline and lease run from
+	at time.Time
+	// release stops renewing msg's lease, once it's been handled or left for redelivery
+	release func()
+}
+
+// consume handles messages from ch until it is closed, up to the limiter's limit at a time, skipping
+//  them once they are abandoned or the batch is full
+func (w *Worker) consume(s *session, ch <-chan delivery) {
+	if w.batchHandler != nil {
+		w.consumeBatches(s, ch)
+		return
+	}
+	if w.orderingKey != nil {
+		goroutines := w.concurrency
+		if w.autoscale != nil {
+			goroutines = w.autoscale.MaxConcurrency
+		}
+		w.consumeOrdered(s, ch, goroutines)
+		return
+	}
+
+	wg := sync.WaitGroup{}
+	for d := range ch {
+		s.limiter.acquire()
+		wg.Add(1)
+		go func(d delivery) {
+			defer wg.Done()
+			defer s.limiter.release()
+			if !s.abandoned() && s.batch.take() {
+				w.handle(s, d)
+				s.batch.done()
+			} else {
+				d.release()
 			}
+		}(d)
+	}
+	wg.Wait()
+}
+
+// startingConcurrency is the worker's concurrency, within its autoscaling bounds
+func (w *Worker) startingConcurrency() int {
+	n := w.concurrency
+	if a := w.autoscale; a != nil {
+		if n < a.MinConcurrency {
+			n = a.MinConcurrency
+		}
+		if n > a.MaxConcurrency {
+			n = a.MaxConcurrency
+		}
+	}
+	return n
+}
+
+// handle runs the onMessage chain for a single delivered message, then acts on its outcome
+func (w *Worker) handle(s *session, d delivery) {
+	msg, p := d.msg, d.pipe
+	atomic.AddUint64(&w.stats.Handled, 1)
+	if w.duplicate(d) {
+		return
+	}
+	if failures := w.failures(msg, p); w.maxFailures > 0 && failures >= w.maxFailures {
+		w.deadLetter(s, msg, p, w.maxFailureStep, LogCodeRouted, fmt.Sprintf("dead-lettered after %v failures at step %v", failures, p.Step()), d.release)
+		return
+	}
+	ctx, cancel := w.messageContext(s.ctx, msg, p, d.at)
+	defer cancel()
+
+	var elapsed time.Duration
+	for retries := 0; ; retries++ {
+		startTime := time.Now()
+		outcome := s.handler(ctx, msg, p)
+		elapsed += time.Since(startTime)
+		attempt := 0
+		if outcome.Action != ActionComplete && ctx.Err() == context.DeadlineExceeded {
+			outcome = w.timedOut(ctx, msg, p, outcome)
+		} else {
+			outcome, attempt = w.scheduleRetry(msg, p, outcome, retries)
+		}
+		if outcome.Action != ActionRetry || outcome.Delay <= 0 {
+			s.limiter.observe(elapsed, outcome.Err != nil)
+			w.apply(s, msg, p, outcome, d.release)
+			return
+		}
 
-			if shouldcomplete {
-				retry.Do(func() error {
-					return w.pipe.Log(msg.GetStringId(), 0, fmt.Sprintf("completed step %v", w.Step()))
-				}, 40, 250)
-				retry.Do(func() error {
-					return w.pipe.Complete(msg.GetStringId())
-				}, 40, 250)
+		atomic.AddUint64(&w.stats.Retried, 1)
+		w.log(msg, p, LogCodeFailed, w.retryMessage(outcome, attempt))
+		w.notifyError(msg, p, outcome.Err)
+		if !s.pause(ctx, outcome.Delay) {
+			// past its deadline, or shutting down, it's left for pipelinr to redeliver
+			d.release()
+			return
+		}
+	}
+}
+
+// failures counts the route log entries for this step with negative codes, ie: failed attempts at it
+func (w *Worker) failures(msg *messages.Event, p *pipe.Pipe) int {
+	count := 0
+	for _, entry := range msg.GetMessage().GetRouteLog() {
+		if entry.GetStep() == p.Step() && entry.GetCode() < 0 {
+			count++
+		}
+	}
+	return count
+}
+
+// timedOut returns the outcome for a message whose handlers ran past their deadline
+func (w *Worker) timedOut(ctx context.Context, msg *messages.Event, p *pipe.Pipe, outcome Outcome) Outcome {
+	atomic.AddUint64(&w.stats.Timeouts, 1)
+	er := fmt.Errorf("%w after %v", ErrTimeout, time.Since(DeliveredAt(ctx)).Round(time.Millisecond))
+	if w.timeoutAction == ActionComplete {
+		w.log(msg, p, LogCodeFailed, fmt.Sprintf("%v timed out, with error %v", outcome.source(), er.Error()))
+	}
+	return Outcome{Action: w.timeoutAction, Err: er, handler: outcome.handler}
+}
+
+// apply performs the single action an outcome calls for, then releases the message's lease, or hands
+//  release on with the message to be completed
+func (w *Worker) apply(s *session, msg *messages.Event, p *pipe.Pipe, outcome Outcome, release func()) {
+	switch outcome.Action {
+	case ActionComplete:
+		w.complete(s, msg, p, LogCodeCompleted, fmt.Sprintf("completed step %v", p.Step()), release)
+
+	case ActionFail:
+		atomic.AddUint64(&w.stats.Failed, 1)
+		w.log(msg, p, LogCodeFailed, fmt.Sprintf("failed to run %v, with error %v", outcome.source(), errString(outcome.Err)))
+		w.notifyError(msg, p, outcome.Err)
+
+		switch w.failureAction {
+		case ActionComplete:
+			w.complete(s, msg, p, LogCodeCompleted, fmt.Sprintf("completed step %v", p.Step()), release)
+		case ActionDeadLetter:
+			w.deadLetter(s, msg, p, "", LogCodeRouted, fmt.Sprintf("dead-lettered after %v failed", outcome.source()), release)
+		case ActionFail:
+			if len(w.onError) == 0 {
+				w.complete(s, msg, p, LogCodeCompleted, fmt.Sprintf("completed step %v", p.Step()), release)
+			} else {
+				release()
 			}
+		default:
+			atomic.AddUint64(&w.stats.Left, 1)
+			release()
+		}
+
+	case ActionRetry:
+		release()
+		atomic.AddUint64(&w.stats.Retried, 1)
+		w.log(msg, p, LogCodeFailed, fmt.Sprintf("%v will retry on redelivery, with error %v", outcome.source(), errString(outcome.Err)))
+		w.notifyError(msg, p, outcome.Err)
+
+	case ActionSkipTo:
+		w.route(s, msg, p, outcome.Step, LogCodeRouted, fmt.Sprintf("%v skipped to step %v", outcome.source(), outcome.Step), release)
+
+	case ActionDeadLetter:
+		w.notifyError(msg, p, outcome.Err)
+		w.deadLetter(s, msg, p, outcome.Step, LogCodeFailed, fmt.Sprintf("%v dead-lettered the message, with error %v", outcome.source(), errString(outcome.Err)), release)
+
+	default:
+		// ActionLeave
+		release()
+		atomic.AddUint64(&w.stats.Left, 1)
+		if outcome.Err != nil {
+			w.log(msg, p, LogCodeFailed, fmt.Sprintf("%v left the message for redelivery, with error %v", outcome.source(), errString(outcome.Err)))
+			w.notifyError(msg, p, outcome.Err)
 		}
 	}
+}
+
+// deadLetter routes a message to step, or the worker's dead-letter step if step is empty
+func (w *Worker) deadLetter(s *session, msg *messages.Event, p *pipe.Pipe, step string, code int32, message string, release func()) {
+	if step == "" {
+		step = w.deadLetterStep
+	}
+	if step == "" {
+		release()
+		w.log(msg, p, LogCodeFailed, "no dead-letter step set, leaving the message for redelivery")
+		return
+	}
+	atomic.AddUint64(&w.stats.DeadLettered, 1)
+	w.route(s, msg, p, step, code, fmt.Sprintf("%v, to %v", message, step), release)
+}
+
+// route adds step after this one, then logs and completes the message
+func (w *Worker) route(s *session, msg *messages.Event, p *pipe.Pipe, step string, code int32, message string, release func()) {
+	if step == "" {
+		release()
+		w.log(msg, p, LogCodeFailed, "no step to route to, leaving the message for redelivery")
+		return
+	}
+	if er := w.callAPI(w.apiRetry, func() error {
+		return p.AddSteps(msg.GetStringId(), []string{step})
+	}); er != nil {
+		release()
+		w.log(msg, p, LogCodeFailed, fmt.Sprintf("failed to route to step %v, with error %v", step, er.Error()))
+		return
+	}
+	w.complete(s, msg, p, code, message, release)
+}
+
+// complete logs message to the route log, then releases the message's lease and completes this step,
+//  or queues them for the worker's completer, waiting for room in its queue if it's behind. A queued
+//  message's lease is held until the completer is done with it
+func (w *Worker) complete(s *session, msg *messages.Event, p *pipe.Pipe, code int32, message string, release func()) {
+	atomic.AddUint64(&w.stats.Completed, 1)
+	if s.completer != nil {
+		s.completer.queue <- completion{msg: msg, p: p, code: code, message: message, release: release}
+		return
+	}
+	w.log(msg, p, code, message)
+	release()
+	w.completeStep(msg, p, w.apiRetry)
+}
+
+// completeStep completes this step, retrying by policy, and records it in the dedup store
+//  A step that was already completed means this was a duplicate delivery, and isn't retried
+func (w *Worker) completeStep(msg *messages.Event, p *pipe.Pipe, policy retry.Policy) {
+	duplicate := false
+	er := w.callAPI(policy, func() error {
+		er := p.Complete(msg.GetStringId())
+		if errors.Is(er, drivers.ErrStepCompleted) {
+			duplicate = true
+			return nil
+		}
+		return er
+	})
+	if duplicate {
+		atomic.AddUint64(&w.stats.Duplicates, 1)
+	}
+	if er != nil {
+		atomic.AddUint64(&w.stats.Uncompleted, 1)
+		w.notifyError(msg, p, fmt.Errorf("complete: %w", er))
+		return
+	}
+	if w.dedup != nil {
+		if er := w.dedup.Mark(msg.GetStringId(), p.Step()); er != nil {
+			w.notifyError(msg, p, fmt.Errorf("dedup store: %w", er))
+		}
+	}
+}
 
-	return errors.New("worker stopped")
+// duplicate returns whether the dedup store has d's message as completed at this step, releasing its
+//  lease and completing it again or skipping it if so
+func (w *Worker) duplicate(d delivery) bool {
+	msg, p := d.msg, d.pipe
+	if w.dedup == nil {
+		return false
+	}
+	seen, er := w.dedup.Seen(msg.GetStringId(), p.Step())
+	if er != nil {
+		w.notifyError(msg, p, fmt.Errorf("dedup store: %w", er))
+		return false
+	}
+	if !seen {
+		return false
+	}
+	atomic.AddUint64(&w.stats.Duplicates, 1)
+	d.release()
+	if w.dedupAction == ActionComplete {
+		w.callAPI(w.apiRetry, func() error {
+			if er := p.Complete(msg.GetStringId()); !errors.Is(er, drivers.ErrStepCompleted) {
+				return er
+			}
+			return nil
+		})
+	}
+	return true
+}
+
+func (w *Worker) log(msg *messages.Event, p *pipe.Pipe, code int32, message string) {
+	w.callAPI(w.apiRetry, func() error {
+		return p.Log(msg.GetStringId(), code, message)
+	})
+}
+
+// callAPI makes a pipelinr API call, retrying it by policy for as long as the run's handlers may run,
+//  and as the worker's retry budget allows
+func (w *Worker) callAPI(policy retry.Policy, fn func() error) error {
+	if policy.Budget == nil {
+		policy.Budget = w.retryBudget
+	}
+	w.mu.Lock()
+	ctx := w.apiCtx
+	w.mu.Unlock()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return retry.DoContext(ctx, policy, fn)
+}
+
+// notifyError runs the OnError handlers, if there is an error to report
+func (w *Worker) notifyError(msg *messages.Event, p *pipe.Pipe, er error) {
+	if er == nil {
+		return
+	}
+	for ndx := range w.onError {
+		w.onError[ndx](msg, er, p)
+	}
+}
+
+func errString(er error) string {
+	if er == nil {
+		return "<nil>"
+	}
+	return er.Error()
 }
@@ -1,15 +1,19 @@
 package worker
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"strconv"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/nochte/pipelinr-clients/go/lib"
+	"github.com/nochte/pipelinr-clients/go/lib/retry"
 	"github.com/nochte/pipelinr-clients/go/pipe"
+	"github.com/nochte/pipelinr-clients/go/pipe/drivers"
 	"github.com/nochte/pipelinr-protocol/protobuf/messages"
 	"github.com/nochte/pipelinr-protocol/protobuf/pipes"
 	. "github.com/smartystreets/goconvey/convey"
@@ -44,7 +48,7 @@ func TestWorker(t *testing.T) {
 					worker.SetReceiveOptions(&i3250, nil, &i64300, nil, nil, nil, nil, nil)
 					workers = append(workers, worker)
 					ppipes = append(ppipes, p)
-					go worker.Run()
+					go worker.Run(context.Background())
 					return worker
 				}
 
@@ -286,3 +290,1002 @@ func TestWorker(t *testing.T) {
 		}
 	})
 }
+
+// newMemoryWorker returns a worker on a fresh step of driver, receiving up to count messages at a time
+func newMemoryWorker(driver drivers.Driver, count int32) *Worker {
+	p := pipe.New(driver, lib.GenerateRandomString(8))
+	i64hundred := int64(100)
+	p.SetReceiveOptions(&count, nil, &i64hundred, nil, nil, nil, nil, nil)
+	return New(p)
+}
+
+func TestWorkerShutdown(t *testing.T) {
+	Convey("Worker shutdown", t, func() {
+		driver := drivers.NewMemoryDriver()
+		driver.SetTimeUnit(time.Millisecond * 10)
+		w := newMemoryWorker(driver, 5)
+
+		started := make(chan string, 10)
+		release := make(chan struct{})
+		w.OnMessage(func(msg *messages.Event, p *pipe.Pipe) error {
+			started <- msg.GetStringId()
+			<-release
+			return nil
+		})
+
+		ids := make([]string, 0, 3)
+		for i := 0; i < 3; i++ {
+			id, _ := w.Pipe().Send(`{}`, []string{w.Step(), "next"})
+			ids = append(ids, id)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		ran := make(chan error)
+
+		Convey("lets in-flight and buffered handlers finish, returning nil", func() {
+			go func() { ran <- w.Run(ctx) }()
+			<-started
+			cancel()
+			close(release)
+
+			So(<-ran, ShouldBeNil)
+			for _, id := range ids {
+				So(driver.Message(id).GetCompletedSteps(), ShouldResemble, []string{w.Step()})
+			}
+		})
+
+		Convey("abandons buffered messages under DrainAbandon", func() {
+			w.SetDrain(time.Second, DrainAbandon)
+			go func() { ran <- w.Run(ctx) }()
+			first := <-started
+			cancel()
+			time.Sleep(time.Millisecond * 20)
+			close(release)
+
+			So(<-ran, ShouldBeNil)
+			So(len(started), ShouldEqual, 0)
+			for _, id := range ids {
+				if id == first {
+					So(driver.Message(id).GetCompletedSteps(), ShouldResemble, []string{w.Step()})
+				} else {
+					So(driver.Message(id).GetCompletedSteps(), ShouldBeEmpty)
+				}
+			}
+		})
+
+		Convey("gives up on handlers at the drain timeout", func() {
+			w.SetDrain(time.Millisecond*20, DrainProcess)
+			go func() { ran <- w.Run(ctx) }()
+			<-started
+			w.Stop()
+
+			er := <-ran
+			So(errors.Is(er, context.DeadlineExceeded), ShouldBeTrue)
+			close(release)
+		})
+	})
+}
+
+// countingDriver counts Complete calls per message id
+type countingDriver struct {
+	*drivers.MemoryDriver
+	mu        sync.Mutex
+	completes map[string]int
+}
+
+func newCountingDriver() *countingDriver {
+	d := &countingDriver{MemoryDriver: drivers.NewMemoryDriver(), completes: make(map[string]int)}
+	d.SetTimeUnit(time.Millisecond * 10)
+	return d
+}
+
+func (d *countingDriver) Complete(id, step string) error {
+	d.mu.Lock()
+	d.completes[id]++
+	d.mu.Unlock()
+	return d.MemoryDriver.Complete(id, step)
+}
+
+func (d *countingDriver) Completes(id string) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.completes[id]
+}
+
+func TestWorkerConcurrency(t *testing.T) {
+	Convey("Worker concurrency", t, func() {
+		driver := newCountingDriver()
+		p := pipe.New(driver, lib.GenerateRandomString(8))
+		i32fifty := int32(50)
+		i64hundred := int64(100)
+		p.SetReceiveOptions(&i32fifty, nil, &i64hundred, nil, nil, nil, nil, nil)
+		w := New(p)
+
+		inflight := int64(0)
+		maxinflight := int64(0)
+		handled := make(chan string, 100)
+		w.OnMessage(func(msg *messages.Event, p *pipe.Pipe) error {
+			n := atomic.AddInt64(&inflight, 1)
+			for {
+				max := atomic.LoadInt64(&maxinflight)
+				if n <= max || atomic.CompareAndSwapInt64(&maxinflight, max, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond * 20)
+			atomic.AddInt64(&inflight, -1)
+			handled <- msg.GetStringId()
+			return nil
+		})
+
+		ids := make([]string, 0, 50)
+		for i := 0; i < 50; i++ {
+			id, _ := p.Send(fmt.Sprintf(`{"num":%v}`, i), []string{p.Step()})
+			ids = append(ids, id)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		Convey("handles messages in parallel, completing each exactly once", func() {
+			w.SetConcurrency(10)
+			startTime := time.Now()
+			ran := make(chan error)
+			go func() { ran <- w.Run(ctx) }()
+
+			for range ids {
+				<-handled
+			}
+			So(time.Since(startTime), ShouldBeLessThan, time.Millisecond*500)
+			cancel()
+			So(<-ran, ShouldBeNil)
+
+			So(atomic.LoadInt64(&maxinflight), ShouldBeLessThanOrEqualTo, 10)
+			So(atomic.LoadInt64(&maxinflight), ShouldBeGreaterThan, 1)
+			for _, id := range ids {
+				So(driver.Completes(id), ShouldEqual, 1)
+				So(driver.Message(id).GetCompletedSteps(), ShouldResemble, []string{p.Step()})
+			}
+			So(len(handled), ShouldEqual, 0)
+		})
+
+		Convey("defaults to handling one message at a time", func() {
+			go w.Run(ctx)
+			for i := 0; i < 5; i++ {
+				<-handled
+			}
+			So(atomic.LoadInt64(&maxinflight), ShouldEqual, 1)
+		})
+	})
+}
+
+// routeLogCodes returns the codes of a message's route log
+func routeLogCodes(msg *messages.MessageEnvelop) []int32 {
+	out := make([]int32, 0, len(msg.GetRouteLog()))
+	for _, l := range msg.GetRouteLog() {
+		out = append(out, l.GetCode())
+	}
+	return out
+}
+
+// eventually waits up to a second for cond to be true
+func eventually(cond func() bool) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond * 5) {
+		if cond() {
+			return true
+		}
+	}
+	return cond()
+}
+
+func TestWorkerOutcomes(t *testing.T) {
+	Convey("Worker outcomes", t, func() {
+		driver := newCountingDriver()
+		w := newMemoryWorker(driver, 5)
+
+		calls := int64(0)
+		id, _ := w.Pipe().Send(`{}`, []string{w.Step(), "next"})
+		completed := func() bool {
+			return len(driver.Message(id).GetCompletedSteps()) > 0
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		Reset(cancel)
+
+		Convey("completes exactly once after the whole chain", func() {
+			for i := 0; i < 3; i++ {
+				w.OnMessageHandler(func(ctx context.Context, msg *messages.Event, p *pipe.Pipe) Outcome {
+					atomic.AddInt64(&calls, 1)
+					return Completed()
+				})
+			}
+			go w.Run(ctx)
+
+			So(eventually(completed), ShouldBeTrue)
+			So(atomic.LoadInt64(&calls), ShouldEqual, 3)
+			So(driver.Completes(id), ShouldEqual, 1)
+			So(routeLogCodes(driver.Message(id)), ShouldResemble, []int32{LogCodeCompleted})
+		})
+
+		Convey("fails", func() {
+			w.OnMessage(func(msg *messages.Event, p *pipe.Pipe) error {
+				atomic.AddInt64(&calls, 1)
+				return errors.New("app fail")
+			})
+
+			Convey("completing by default", func() {
+				go w.Run(ctx)
+				So(eventually(completed), ShouldBeTrue)
+				So(routeLogCodes(driver.Message(id)), ShouldResemble, []int32{LogCodeFailed, LogCodeCompleted})
+			})
+
+			Convey("leaving the message when asked to", func() {
+				w.SetFailureAction(ActionLeave)
+				go w.Run(ctx)
+				So(eventually(func() bool { return atomic.LoadInt64(&calls) > 0 }), ShouldBeTrue)
+				time.Sleep(time.Millisecond * 20)
+				So(completed(), ShouldBeFalse)
+				So(routeLogCodes(driver.Message(id)), ShouldResemble, []int32{LogCodeFailed})
+			})
+
+			Convey("dead-lettering when asked to", func() {
+				w.SetFailureAction(ActionDeadLetter)
+				w.SetDeadLetterStep("dlq")
+				go w.Run(ctx)
+				So(eventually(completed), ShouldBeTrue)
+				So(driver.Message(id).GetRoute(), ShouldResemble, []string{w.Step(), "dlq", "next"})
+				So(routeLogCodes(driver.Message(id)), ShouldResemble, []int32{LogCodeFailed, LogCodeRouted})
+			})
+		})
+
+		Convey("retries after a delay", func() {
+			errored := int64(0)
+			w.OnError(func(msg *messages.Event, er error, p *pipe.Pipe) {
+				atomic.AddInt64(&errored, 1)
+			})
+			w.OnMessageHandler(func(ctx context.Context, msg *messages.Event, p *pipe.Pipe) Outcome {
+				if atomic.AddInt64(&calls, 1) == 1 {
+					return RetryAfter(time.Millisecond*20, errors.New("not yet"))
+				}
+				return Completed()
+			})
+			go w.Run(ctx)
+
+			So(eventually(completed), ShouldBeTrue)
+			So(atomic.LoadInt64(&calls), ShouldEqual, 2)
+			So(atomic.LoadInt64(&errored), ShouldEqual, 1)
+			So(driver.Completes(id), ShouldEqual, 1)
+			So(routeLogCodes(driver.Message(id)), ShouldResemble, []int32{LogCodeFailed, LogCodeCompleted})
+		})
+
+		Convey("handles other messages while one waits to retry", func() {
+			w.SetConcurrency(1)
+			w.OnMessageHandler(func(ctx context.Context, msg *messages.Event, p *pipe.Pipe) Outcome {
+				if msg.GetStringId() == id && atomic.AddInt64(&calls, 1) == 1 {
+					return RetryAfter(time.Millisecond*300, errors.New("not yet"))
+				}
+				return Completed()
+			})
+			other, _ := w.Pipe().Send(`{}`, []string{w.Step()})
+			go w.Run(ctx)
+
+			So(eventually(func() bool { return driver.Completes(other) == 1 }), ShouldBeTrue)
+			So(completed(), ShouldBeFalse)
+			So(eventually(completed), ShouldBeTrue)
+			So(atomic.LoadInt64(&calls), ShouldEqual, 2)
+		})
+
+		Convey("skips to a step", func() {
+			w.OnMessageHandler(func(ctx context.Context, msg *messages.Event, p *pipe.Pipe) Outcome {
+				return SkipTo("elsewhere")
+			})
+			go w.Run(ctx)
+
+			So(eventually(completed), ShouldBeTrue)
+			So(driver.Message(id).GetRoute(), ShouldResemble, []string{w.Step(), "elsewhere", "next"})
+			So(routeLogCodes(driver.Message(id)), ShouldResemble, []int32{LogCodeRouted})
+			evts, _ := driver.Recv(&pipes.ReceiveOptions{Pipe: "elsewhere", Count: 1})
+			So(len(evts), ShouldEqual, 1)
+		})
+
+		Convey("dead-letters to the outcome's step", func() {
+			w.SetDeadLetterStep("dlq")
+			w.OnMessageHandler(func(ctx context.Context, msg *messages.Event, p *pipe.Pipe) Outcome {
+				o := DeadLetter(errors.New("poison"))
+				o.Step = "poison-dlq"
+				return o
+			})
+			go w.Run(ctx)
+
+			So(eventually(completed), ShouldBeTrue)
+			So(driver.Message(id).GetRoute(), ShouldResemble, []string{w.Step(), "poison-dlq", "next"})
+			So(routeLogCodes(driver.Message(id)), ShouldResemble, []int32{LogCodeFailed})
+		})
+
+		Convey("leaves the message for redelivery", func() {
+			i64five := int64(5)
+			w.SetReceiveOptions(nil, nil, &i64five, nil, nil, nil, nil, nil)
+			w.OnMessageHandler(func(ctx context.Context, msg *messages.Event, p *pipe.Pipe) Outcome {
+				if atomic.AddInt64(&calls, 1) == 1 {
+					return Leave(nil)
+				}
+				return Completed()
+			})
+			go w.Run(ctx)
+
+			So(eventually(completed), ShouldBeTrue)
+			So(driver.Deliveries(id, w.Step()), ShouldEqual, 2)
+			So(routeLogCodes(driver.Message(id)), ShouldResemble, []int32{LogCodeCompleted})
+		})
+	})
+}
+
+func TestWorkerPanics(t *testing.T) {
+	Convey("Worker panic recovery", t, func() {
+		driver := newCountingDriver()
+		w := newMemoryWorker(driver, 5)
+		first, _ := w.Pipe().Send(`{"panic":true}`, []string{w.Step()})
+		second, _ := w.Pipe().Send(`{"panic":false}`, []string{w.Step()})
+
+		errs := make(chan error, 2)
+		w.OnError(func(msg *messages.Event, er error, p *pipe.Pipe) {
+			errs <- er
+		})
+		w.SetFailureAction(ActionComplete)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		Reset(cancel)
+
+		Convey("in a handler, logs the stack and keeps working", func() {
+			w.OnMessage(func(msg *messages.Event, p *pipe.Pipe) error {
+				if gjson.Get(msg.GetMessage().GetPayload(), "panic").Bool() {
+					panic("boom")
+				}
+				return nil
+			})
+			go w.Run(ctx)
+
+			var perr *PanicError
+			So(errors.As(<-errs, &perr), ShouldBeTrue)
+			So(perr.Value, ShouldEqual, "boom")
+			So(eventually(func() bool {
+				return len(driver.Message(first).GetCompletedSteps()) > 0 && len(driver.Message(second).GetCompletedSteps()) > 0
+			}), ShouldBeTrue)
+
+			log := driver.Message(first).GetRouteLog()
+			So(routeLogCodes(driver.Message(first)), ShouldResemble, []int32{LogCodeFailed, LogCodeCompleted})
+			So(log[0].GetMessage(), ShouldStartWith, "failed to run handler 0, with error panic: boom\ngoroutine")
+			So(log[0].GetMessage(), ShouldContainSubstring, "worker_test.go")
+			So(w.Stats().Panics, ShouldEqual, 1)
+			So(w.Stats().Failed, ShouldEqual, 1)
+			So(w.Stats().Handled, ShouldEqual, 2)
+			So(w.Stats().Completed, ShouldEqual, 2)
+		})
+
+		Convey("in middleware", func() {
+			w.Use(func(next Handler) Handler {
+				return func(ctx context.Context, msg *messages.Event, p *pipe.Pipe) Outcome {
+					panic("middleware boom")
+				}
+			})
+			go w.Run(ctx)
+
+			var perr *PanicError
+			So(errors.As(<-errs, &perr), ShouldBeTrue)
+			So(perr.Value, ShouldEqual, "middleware boom")
+			So(eventually(func() bool {
+				return len(driver.Message(first).GetCompletedSteps()) > 0
+			}), ShouldBeTrue)
+			So(driver.Message(first).GetRouteLog()[0].GetMessage(), ShouldStartWith, "failed to run middleware, with error panic: middleware boom")
+		})
+	})
+}
+
+func TestWorkerTimeouts(t *testing.T) {
+	Convey("Worker handler timeouts", t, func() {
+		driver := newCountingDriver()
+		w := newMemoryWorker(driver, 5)
+		id, _ := w.Pipe().Send(`{}`, []string{w.Step()})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		Reset(cancel)
+
+		Convey("handlers get the message's id, step, delivery time and a deadline", func() {
+			type seen struct {
+				id, step    string
+				deliveredAt time.Time
+				deadline    time.Time
+			}
+			seenc := make(chan seen, 1)
+			w.OnMessageHandler(func(ctx context.Context, msg *messages.Event, p *pipe.Pipe) Outcome {
+				deadline, _ := ctx.Deadline()
+				seenc <- seen{MessageID(ctx), Step(ctx), DeliveredAt(ctx), deadline}
+				return Completed()
+			})
+			startTime := time.Now()
+			go w.Run(ctx)
+
+			got := <-seenc
+			So(got.id, ShouldEqual, id)
+			So(got.step, ShouldEqual, w.Step())
+			So(got.deliveredAt, ShouldHappenOnOrBetween, startTime, time.Now())
+			So(got.deadline, ShouldEqual, got.deliveredAt.Add(time.Second*90))
+		})
+
+		Convey("the deadline runs from when the message was received, not when its handlers start", func() {
+			w.SetHandlerTimeout(time.Second, ActionLeave)
+			second, _ := w.Pipe().Send(`{}`, []string{w.Step()})
+			type seen struct {
+				deliveredAt, startedAt, deadline time.Time
+			}
+			seenc := make(chan seen, 1)
+			w.OnMessageHandler(func(ctx context.Context, msg *messages.Event, p *pipe.Pipe) Outcome {
+				if msg.GetStringId() == id {
+					time.Sleep(time.Millisecond * 50)
+				} else {
+					deadline, _ := ctx.Deadline()
+					seenc <- seen{DeliveredAt(ctx), time.Now(), deadline}
+				}
+				return Completed()
+			})
+			go w.Run(ctx)
+
+			got := <-seenc
+			So(eventually(func() bool { return driver.Completes(second) == 1 }), ShouldBeTrue)
+			So(got.startedAt.Sub(got.deliveredAt), ShouldBeGreaterThanOrEqualTo, time.Millisecond*40)
+			So(got.deadline, ShouldEqual, got.deliveredAt.Add(time.Second))
+		})
+
+		Convey("a handler running past its deadline", func() {
+			w.OnMessageHandler(func(ctx context.Context, msg *messages.Event, p *pipe.Pipe) Outcome {
+				<-ctx.Done()
+				return Fail(ctx.Err())
+			})
+
+			Convey("is left for redelivery by default", func() {
+				w.SetHandlerTimeout(time.Millisecond*20, ActionLeave)
+				go w.Run(ctx)
+
+				So(eventually(func() bool { return w.Stats().Timeouts > 0 }), ShouldBeTrue)
+				So(eventually(func() bool { return len(driver.Message(id).GetRouteLog()) > 0 }), ShouldBeTrue)
+				So(driver.Message(id).GetRouteLog()[0].GetMessage(), ShouldStartWith, "handler 0 left the message for redelivery, with error handler timed out after")
+				So(driver.Message(id).GetCompletedSteps(), ShouldBeEmpty)
+			})
+
+			Convey("takes the configured outcome", func() {
+				w.SetHandlerTimeout(time.Millisecond*20, ActionDeadLetter)
+				w.SetDeadLetterStep("too-slow")
+				go w.Run(ctx)
+
+				So(eventually(func() bool { return len(driver.Message(id).GetCompletedSteps()) > 0 }), ShouldBeTrue)
+				So(driver.Message(id).GetRoute(), ShouldResemble, []string{w.Step(), "too-slow"})
+				So(w.Stats().Timeouts, ShouldEqual, 1)
+			})
+		})
+	})
+}
+
+func TestWorkerLeaseExtension(t *testing.T) {
+	Convey("Worker lease extension", t, func() {
+		driver := newCountingDriver()
+		w := newMemoryWorker(driver, 5)
+		w.SetConcurrency(2)
+		// redelivered after 50ms without an ack
+		redelivery := int64(5)
+		w.SetReceiveOptions(nil, nil, &redelivery, nil, nil, nil, nil, nil)
+		id, _ := w.Pipe().Send(`{}`, []string{w.Step()})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		Reset(cancel)
+
+		calls := int64(0)
+		slow := func(msg *messages.Event, p *pipe.Pipe) error {
+			atomic.AddInt64(&calls, 1)
+			time.Sleep(time.Millisecond * 200)
+			return nil
+		}
+
+		Convey("without it, a slow handler's message is redelivered", func() {
+			w.OnMessage(slow)
+			go w.Run(ctx)
+
+			So(eventually(func() bool { return driver.Completes(id) > 0 }), ShouldBeTrue)
+			So(driver.Deliveries(id, w.Step()), ShouldBeGreaterThan, 1)
+		})
+
+		Convey("renews the lease while the handler runs", func() {
+			w.SetLeaseExtension(time.Millisecond*20, time.Second)
+			w.OnMessage(slow)
+			go w.Run(ctx)
+
+			So(eventually(func() bool { return driver.Completes(id) > 0 }), ShouldBeTrue)
+			So(driver.Deliveries(id, w.Step()), ShouldEqual, 1)
+			So(atomic.LoadInt64(&calls), ShouldEqual, 1)
+			So(w.Stats().LeaseRenewals, ShouldBeGreaterThan, 0)
+
+			Convey("and stops renewing once it's done", func() {
+				renewals := w.Stats().LeaseRenewals
+				time.Sleep(time.Millisecond * 60)
+				So(w.Stats().LeaseRenewals, ShouldEqual, renewals)
+			})
+		})
+
+		Convey("renews the lease of a message waiting for a handler", func() {
+			w.SetConcurrency(1)
+			w.SetLeaseExtension(time.Millisecond*20, time.Second)
+			waiting, _ := w.Pipe().Send(`{}`, []string{w.Step()})
+			w.OnMessage(slow)
+			go w.Run(ctx)
+
+			So(eventually(func() bool { return driver.Completes(id) > 0 && driver.Completes(waiting) > 0 }), ShouldBeTrue)
+			So(driver.Deliveries(id, w.Step()), ShouldEqual, 1)
+			So(driver.Deliveries(waiting, w.Step()), ShouldEqual, 1)
+			So(atomic.LoadInt64(&calls), ShouldEqual, 2)
+		})
+
+		Convey("doesn't renew the lease of a message still in the pipe", func() {
+			w.SetConcurrency(1)
+			w.SetLeaseExtension(time.Millisecond*20, time.Second)
+			ids := []string{id}
+			for i := 0; i < 4; i++ {
+				next, _ := w.Pipe().Send(`{}`, []string{w.Step()})
+				ids = append(ids, next)
+			}
+			w.OnMessage(slow)
+			go w.Run(ctx)
+
+			So(eventually(func() bool { return driver.Deliveries(ids[4], w.Step()) > 1 }), ShouldBeTrue)
+			So(driver.Deliveries(ids[0], w.Step()), ShouldEqual, 1)
+			So(driver.Deliveries(ids[1], w.Step()), ShouldEqual, 1)
+		})
+
+		Convey("gives up after the max lease", func() {
+			w.SetLeaseExtension(time.Millisecond*20, time.Millisecond*60)
+			w.SetHandlerTimeout(time.Second, ActionLeave)
+			w.OnMessage(slow)
+			go w.Run(ctx)
+
+			So(eventually(func() bool { return driver.Deliveries(id, w.Step()) > 1 }), ShouldBeTrue)
+			So(w.Stats().LeasesExpired, ShouldBeGreaterThan, 0)
+		})
+
+		Convey("makes the max lease the handlers' deadline", func() {
+			w.SetLeaseExtension(time.Millisecond*20, time.Minute)
+			deadlines := make(chan time.Time, 1)
+			w.OnMessageHandler(func(ctx context.Context, msg *messages.Event, p *pipe.Pipe) Outcome {
+				deadline, _ := ctx.Deadline()
+				deadlines <- deadline
+				return Completed()
+			})
+			go w.Run(ctx)
+
+			deadline := <-deadlines
+			So(deadline, ShouldHappenWithin, time.Second, time.Now().Add(time.Minute))
+		})
+	})
+}
+
+func TestWorkerMaxFailures(t *testing.T) {
+	Convey("Worker max failures", t, func() {
+		driver := newCountingDriver()
+		w := newMemoryWorker(driver, 5)
+		redelivery := int64(5)
+		w.SetReceiveOptions(nil, nil, &redelivery, nil, nil, nil, nil, nil)
+		w.SetFailureAction(ActionLeave)
+		id, _ := w.Pipe().Send(`{}`, []string{w.Step(), "next"})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		Reset(cancel)
+
+		calls := int64(0)
+		w.OnMessage(func(msg *messages.Event, p *pipe.Pipe) error {
+			atomic.AddInt64(&calls, 1)
+			return errors.New("poison")
+		})
+		completed := func() bool {
+			return len(driver.Message(id).GetCompletedSteps()) > 0
+		}
+
+		Convey("dead-letters a message once it has failed enough times", func() {
+			w.SetMaxFailures(3, "poisoned")
+			go w.Run(ctx)
+
+			So(eventually(completed), ShouldBeTrue)
+			So(atomic.LoadInt64(&calls), ShouldEqual, 3)
+			So(driver.Message(id).GetRoute(), ShouldResemble, []string{w.Step(), "poisoned", "next"})
+			logs := driver.Message(id).GetRouteLog()
+			So(logs[len(logs)-1].GetMessage(), ShouldEqual, "dead-lettered after 3 failures at step "+w.Step()+", to poisoned")
+			So(w.Stats().DeadLettered, ShouldEqual, 1)
+		})
+
+		Convey("falls back to the worker's dead-letter step", func() {
+			w.SetMaxFailures(1, "")
+			w.SetDeadLetterStep("dlq")
+			go w.Run(ctx)
+
+			So(eventually(completed), ShouldBeTrue)
+			So(atomic.LoadInt64(&calls), ShouldEqual, 1)
+			So(driver.Message(id).GetRoute(), ShouldResemble, []string{w.Step(), "dlq", "next"})
+		})
+
+		Convey("only counts failures at its own step", func() {
+			w.Pipe().Log(id, LogCodeFailed, "failed elsewhere")
+			driver.AppendLog(id, "other", LogCodeFailed, "failed at another step")
+			w.SetMaxFailures(2, "poisoned")
+			go w.Run(ctx)
+
+			So(eventually(completed), ShouldBeTrue)
+			So(atomic.LoadInt64(&calls), ShouldEqual, 1)
+		})
+	})
+}
+
+func TestWorkerRetrySchedule(t *testing.T) {
+	Convey("Worker retry schedule", t, func() {
+		driver := newCountingDriver()
+		w := newMemoryWorker(driver, 5)
+		w.SetRetrySchedule(time.Millisecond*20, time.Millisecond*40)
+		id, _ := w.Pipe().Send(`{}`, []string{w.Step()})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		Reset(cancel)
+
+		calls := int64(0)
+		times := make(chan time.Time, 10)
+		failUntil := func(n int64) {
+			w.OnMessage(func(msg *messages.Event, p *pipe.Pipe) error {
+				times <- time.Now()
+				if atomic.AddInt64(&calls, 1) <= n {
+					return errors.New("transient")
+				}
+				return nil
+			})
+		}
+		completed := func() bool {
+			return len(driver.Message(id).GetCompletedSteps()) > 0
+		}
+		logMessages := func() []string {
+			out := make([]string, 0)
+			for _, entry := range driver.Message(id).GetRouteLog() {
+				out = append(out, entry.GetMessage())
+			}
+			return out
+		}
+
+		Convey("retries after each delay in turn", func() {
+			failUntil(2)
+			go w.Run(ctx)
+
+			So(eventually(completed), ShouldBeTrue)
+			So(atomic.LoadInt64(&calls), ShouldEqual, 3)
+			first, second, third := <-times, <-times, <-times
+			So(second.Sub(first), ShouldBeGreaterThanOrEqualTo, time.Millisecond*20)
+			So(third.Sub(second), ShouldBeGreaterThanOrEqualTo, time.Millisecond*40)
+			So(logMessages(), ShouldResemble, []string{
+				"handler 0 will retry in 20ms (retry 1 of 2), with error transient",
+				"handler 0 will retry in 40ms (retry 2 of 2), with error transient",
+				"completed step " + w.Step(),
+			})
+			So(w.Stats().Retried, ShouldEqual, 2)
+		})
+
+		Convey("takes the failure action once the schedule runs out", func() {
+			failUntil(10)
+			w.SetFailureAction(ActionDeadLetter)
+			w.SetDeadLetterStep("dlq")
+			go w.Run(ctx)
+
+			So(eventually(completed), ShouldBeTrue)
+			So(atomic.LoadInt64(&calls), ShouldEqual, 3)
+			So(driver.Message(id).GetRoute(), ShouldResemble, []string{w.Step(), "dlq"})
+		})
+
+		Convey("picks up where a redelivered message left off", func() {
+			w.Pipe().Log(id, LogCodeFailed, "handler 0 will retry in 20ms (retry 1 of 2), with error transient")
+			failUntil(10)
+			w.SetFailureAction(ActionComplete)
+			go w.Run(ctx)
+
+			So(eventually(completed), ShouldBeTrue)
+			So(atomic.LoadInt64(&calls), ShouldEqual, 2)
+			So(logMessages()[1], ShouldEqual, "handler 0 will retry in 40ms (retry 2 of 2), with error transient")
+		})
+	})
+}
+
+func TestWorkerDedup(t *testing.T) {
+	Convey("Worker dedup", t, func() {
+		driver := newCountingDriver()
+		w := newMemoryWorker(driver, 5)
+		store := NewMemoryDedup(0)
+		id, _ := w.Pipe().Send(`{}`, []string{w.Step()})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		Reset(cancel)
+
+		calls := int64(0)
+		w.OnMessage(func(msg *messages.Event, p *pipe.Pipe) error {
+			atomic.AddInt64(&calls, 1)
+			return nil
+		})
+		completed := func() bool {
+			return len(driver.Message(id).GetCompletedSteps()) > 0
+		}
+
+		Convey("records completed messages", func() {
+			w.SetDedupStore(store, ActionComplete)
+			go w.Run(ctx)
+
+			So(eventually(func() bool { seen, _ := store.Seen(id, w.Step()); return seen }), ShouldBeTrue)
+			So(w.Stats().Duplicates, ShouldEqual, 0)
+		})
+
+		Convey("completes duplicates again without handling them", func() {
+			store.Mark(id, w.Step())
+			w.SetDedupStore(store, ActionComplete)
+			go w.Run(ctx)
+
+			So(eventually(completed), ShouldBeTrue)
+			So(atomic.LoadInt64(&calls), ShouldEqual, 0)
+			So(w.Stats().Duplicates, ShouldEqual, 1)
+		})
+
+		Convey("skips duplicates", func() {
+			store.Mark(id, w.Step())
+			w.SetDedupStore(store, ActionLeave)
+			go w.Run(ctx)
+
+			So(eventually(func() bool { return w.Stats().Duplicates > 0 }), ShouldBeTrue)
+			So(atomic.LoadInt64(&calls), ShouldEqual, 0)
+			So(driver.Message(id).GetCompletedSteps(), ShouldBeEmpty)
+		})
+
+		Convey("treats an already completed step as a duplicate", func() {
+			w.SetDedupStore(store, ActionComplete)
+			w.OnMessage(func(msg *messages.Event, p *pipe.Pipe) error {
+				// completed elsewhere while this delivery was being handled
+				return p.Complete(msg.GetStringId())
+			})
+			go w.Run(ctx)
+
+			So(eventually(func() bool { return w.Stats().Duplicates > 0 }), ShouldBeTrue)
+			So(driver.Completes(id), ShouldEqual, 2)
+			So(eventually(func() bool { seen, _ := store.Seen(id, w.Step()); return seen }), ShouldBeTrue)
+		})
+	})
+}
+
+func TestWorkerMultiPipe(t *testing.T) {
+	Convey("Worker with several pipes", t, func() {
+		driver := newCountingDriver()
+		w := newMemoryWorker(driver, 5)
+		other := pipe.New(driver, lib.GenerateRandomString(8))
+		w.AddPipe(other)
+		i64hundred := int64(100)
+		other.SetReceiveOptions(nil, nil, &i64hundred, nil, nil, nil, nil, nil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		Reset(cancel)
+
+		mu := sync.Mutex{}
+		handled := make([]string, 0)
+		w.OnMessageHandler(func(ctx context.Context, msg *messages.Event, p *pipe.Pipe) Outcome {
+			mu.Lock()
+			defer mu.Unlock()
+			handled = append(handled, Step(ctx))
+			return Completed()
+		})
+
+		Convey("handles every pipe's messages through the pipe they came from", func() {
+			first, _ := driver.Send(`{}`, []string{w.Step()})
+			second, _ := driver.Send(`{}`, []string{other.Step()})
+			go w.Run(ctx)
+
+			So(eventually(func() bool { return driver.Completes(first) == 1 && driver.Completes(second) == 1 }), ShouldBeTrue)
+			So(driver.Message(first).GetCompletedSteps(), ShouldResemble, []string{w.Step()})
+			So(driver.Message(second).GetCompletedSteps(), ShouldResemble, []string{other.Step()})
+			So(driver.Message(second).GetRouteLog()[0].GetStep(), ShouldEqual, other.Step())
+			So(w.Pipes(), ShouldHaveLength, 2)
+			mu.Lock()
+			defer mu.Unlock()
+			So(handled, ShouldContain, other.Step())
+		})
+
+		Convey("takes messages from each pipe in turn", func() {
+			for i := 0; i < 20; i++ {
+				driver.Send(`{}`, []string{w.Step()})
+			}
+			for i := 0; i < 5; i++ {
+				driver.Send(`{}`, []string{other.Step()})
+			}
+			go w.Run(ctx)
+
+			So(eventually(func() bool { return w.Stats().Completed == 25 }), ShouldBeTrue)
+			mu.Lock()
+			defer mu.Unlock()
+			others := 0
+			for _, step := range handled[:14] {
+				if step == other.Step() {
+					others++
+				}
+			}
+			So(others, ShouldEqual, 5)
+		})
+
+		Convey("stops when one of its pipes fails", func() {
+			w.AddPipe(pipe.New(&crashingDriver{MemoryDriver: driver.MemoryDriver}, lib.GenerateRandomString(8)))
+			er := w.Run(ctx)
+			So(er, ShouldNotBeNil)
+			So(errors.Is(er, errDropped), ShouldBeTrue)
+			So(er.Error(), ShouldEqual, "worker pipe stopped: subscription ended: connection dropped")
+		})
+	})
+}
+
+func TestWorkerPause(t *testing.T) {
+	Convey("Worker pause", t, func() {
+		driver := newCountingDriver()
+		w := newMemoryWorker(driver, 1)
+		other := pipe.New(driver, lib.GenerateRandomString(8))
+		w.AddPipe(other)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		Reset(cancel)
+
+		started := make(chan string, 10)
+		release := make(chan struct{})
+		w.OnMessage(func(msg *messages.Event, p *pipe.Pipe) error {
+			started <- msg.GetStringId()
+			<-release
+			return nil
+		})
+		go w.Run(ctx)
+
+		inflight, _ := driver.Send(`{}`, []string{w.Step()})
+		So(<-started, ShouldEqual, inflight)
+
+		w.Pause()
+		So(w.Paused(), ShouldBeTrue)
+		// let the long polls in flight end
+		time.Sleep(time.Millisecond * 150)
+		first, _ := driver.Send(`{}`, []string{w.Step()})
+		second, _ := driver.Send(`{}`, []string{other.Step()})
+
+		close(release)
+		So(eventually(func() bool { return driver.Completes(inflight) == 1 }), ShouldBeTrue)
+		time.Sleep(time.Millisecond * 100)
+		So(driver.Deliveries(first, w.Step()), ShouldEqual, 0)
+		So(driver.Deliveries(second, other.Step()), ShouldEqual, 0)
+
+		w.Resume()
+		So(w.Paused(), ShouldBeFalse)
+		So(eventually(func() bool { return driver.Completes(first) == 1 && driver.Completes(second) == 1 }), ShouldBeTrue)
+	})
+}
+
+func TestWorkerBatch(t *testing.T) {
+	Convey("Worker batches", t, func() {
+		driver := newCountingDriver()
+		w := newMemoryWorker(driver, 5)
+		w.OnMessage(func(msg *messages.Event, p *pipe.Pipe) error {
+			time.Sleep(time.Millisecond * 5)
+			return nil
+		})
+
+		ids := make([]string, 0)
+		for i := 0; i < 6; i++ {
+			id, _ := driver.Send(`{}`, []string{w.Step()})
+			ids = append(ids, id)
+		}
+
+		Convey("stop once the pipe is idle", func() {
+			summary, er := w.RunBatch(context.Background(), BatchOptions{IdleTimeout: time.Millisecond * 200})
+			So(er, ShouldBeNil)
+			So(summary.Reason, ShouldEqual, BatchIdle)
+			So(summary.Stats.Handled, ShouldEqual, 6)
+			So(summary.Stats.Completed, ShouldEqual, 6)
+			So(summary.Elapsed, ShouldBeGreaterThanOrEqualTo, time.Millisecond*200)
+			for _, id := range ids {
+				So(driver.Completes(id), ShouldEqual, 1)
+			}
+
+			Convey("and count only their own messages when run again", func() {
+				// let the long poll in flight end
+				time.Sleep(time.Millisecond * 150)
+				driver.Send(`{}`, []string{w.Step()})
+				summary, er := w.RunBatch(context.Background(), BatchOptions{IdleTimeout: time.Millisecond * 200})
+				So(er, ShouldBeNil)
+				So(summary.Stats.Handled, ShouldEqual, 1)
+				So(w.Stats().Handled, ShouldEqual, 7)
+			})
+		})
+
+		Convey("stop after their max messages", func() {
+			summary, er := w.RunBatch(context.Background(), BatchOptions{MaxMessages: 4})
+			So(er, ShouldBeNil)
+			So(summary.Reason, ShouldEqual, BatchMaxMessages)
+			So(summary.Stats.Handled, ShouldEqual, 4)
+			So(summary.String(), ShouldStartWith, "handled 4 messages in ")
+		})
+
+		Convey("stop after their max duration", func() {
+			w.OnMessage(func(msg *messages.Event, p *pipe.Pipe) error {
+				time.Sleep(time.Millisecond * 100)
+				return nil
+			})
+			w.SetConcurrency(1)
+			summary, er := w.RunBatch(context.Background(), BatchOptions{MaxDuration: time.Millisecond * 150})
+			So(er, ShouldBeNil)
+			So(summary.Reason, ShouldEqual, BatchMaxDuration)
+			So(summary.Elapsed, ShouldBeGreaterThanOrEqualTo, time.Millisecond*150)
+		})
+
+		Convey("stop when cancelled", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			summary, er := w.RunBatch(ctx, BatchOptions{})
+			So(er, ShouldBeNil)
+			So(summary.Reason, ShouldEqual, BatchStopped)
+		})
+	})
+}
+
+func TestWorkerAPIRetry(t *testing.T) {
+	Convey("Worker retrying API calls", t, func() {
+		driver := &gatedDriver{countingDriver: newCountingDriver()}
+		w := newMemoryWorker(driver, 1)
+		retries := int32(0)
+		w.SetAPIRetry(retry.Policy{
+			Backoff:     retry.Constant(time.Millisecond),
+			MaxAttempts: 3,
+			OnRetry: func(attempt int, er error, wait time.Duration) {
+				atomic.AddInt32(&retries, 1)
+			},
+		})
+		w.OnMessage(func(msg *messages.Event, p *pipe.Pipe) error {
+			return nil
+		})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		Reset(cancel)
+		go w.Run(ctx)
+
+		driver.Send(`{}`, []string{w.Step()})
+		So(eventually(func() bool { return w.Stats().Uncompleted == 1 }), ShouldBeTrue)
+		So(atomic.LoadInt32(&retries), ShouldEqual, 2)
+	})
+}
+
+func TestWorkerRetryBudget(t *testing.T) {
+	Convey("Workers sharing a retry budget", t, func() {
+		driver := &gatedDriver{countingDriver: newCountingDriver()}
+		budget := retry.NewBudget(0, 1)
+		retries := int32(0)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		Reset(cancel)
+
+		workers := []*Worker{newMemoryWorker(driver, 1), newMemoryWorker(driver, 1)}
+		for _, w := range workers {
+			w.SetAPIRetry(retry.Policy{
+				Backoff:     retry.Constant(time.Millisecond),
+				MaxAttempts: 10,
+				OnRetry: func(attempt int, er error, wait time.Duration) {
+					atomic.AddInt32(&retries, 1)
+				},
+			})
+			w.SetRetryBudget(budget)
+			w.OnMessage(func(msg *messages.Event, p *pipe.Pipe) error {
+				return nil
+			})
+			go w.Run(ctx)
+			driver.Send(`{}`, []string{w.Step()})
+		}
+
+		So(eventually(func() bool { return workers[0].Stats().Uncompleted == 1 && workers[1].Stats().Uncompleted == 1 }), ShouldBeTrue)
+		So(atomic.LoadInt32(&retries), ShouldEqual, 1)
+		So(budget.Stats().Retries, ShouldEqual, 1)
+		So(budget.Stats().Denied, ShouldBeGreaterThanOrEqualTo, 1)
+	})
+}